@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Caller supplied ids are kept only when they are safe to echo and log
+var requestIdRegexp = regexp.MustCompile("^[A-Za-z0-9._-]{1,128}$")
+
+/*
+	Id of the request, the caller's X-Request-Id when valid, a new one otherwise
+*/
+func requestId(req *http.Request) string {
+
+	if id := req.Header.Get("X-Request-Id"); requestIdRegexp.MatchString(id) {
+		return id
+	}
+
+	return randomHex(16)
+}
+
+/*
+	Logger carrying the request's fields, the standard logger outside a request
+*/
+func LoggerFrom(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(loggerKey).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+/*
+	One line per request once the response is written
+*/
+func logAccess(req *http.Request, rec *statusRecorder, principal string, start time.Time) {
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	route := rec.route
+
+	if len(route) == 0 {
+		route = "unmatched"
+	}
+
+	log.WithFields(log.Fields{
+		"request_id":  RequestIdFrom(req.Context()),
+		"account_sid": principal,
+		"method":      req.Method,
+		"path":        req.URL.Path,
+		"route":       route,
+		"status":      rec.status,
+		"latency_ms":  float64(time.Since(start).Microseconds()) / 1000,
+		"bytes":       rec.bytes,
+		"remote_ip":   ip,
+	}).Infoln("access")
+}
@@ -3,31 +3,54 @@ package main
 import (
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 	pb "github.com/zang-cloud/micro-registration-auth/protos"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-func grpcServiceAuthClient() error {
-	log.Infoln("Registering GRPC service auth client.. ", grpc_addr)
+// Page size used when walking every client of an application
+const listBatchSize = 500
 
-	conn, err := grpc.Dial(grpc_addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithBackoffMaxDelay(30*time.Second))
-	if err != nil {
-		return err
+/*
+	Deadline of each ServiceAuth operation, on top of the request context
+*/
+type RPCTimeouts struct {
+	Create time.Duration `yaml:"create"`
+	Get    time.Duration `yaml:"get"`
+	List   time.Duration `yaml:"list"`
+	Delete time.Duration `yaml:"delete"`
+}
+
+/*
+	Derives the context of a ServiceAuth call from the request context,
+	forwarding request id and principal as gRPC metadata
+*/
+func rpcContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+
+	var md []string
+
+	if id := RequestIdFrom(ctx); len(id) > 0 {
+		md = append(md, "x-request-id", id)
 	}
 
-	AuthClient = &ServiceAuth{
-		ClientConn:    conn,
-		ServiceClient: pb.NewServiceAuthClient(conn),
+	if principal := PrincipalFrom(ctx); len(principal) > 0 {
+		md = append(md, "x-principal", principal)
 	}
 
-	return nil
+	if len(md) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, md...)
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
 
-func CreateNewAppClient(cl *Client, ttlVal string) error {
+func (s *ServiceAuth) CreateNewAppClient(ctx context.Context, cl *Client, ttlVal string) error {
 
 	log.Infoln("Create New App client grpc call... ")
 
@@ -40,37 +63,47 @@ func CreateNewAppClient(cl *Client, ttlVal string) error {
 	request.Client.Nickname = cl.Nickname
 	request.Client.Ttl = int64(ttl)
 	request.Client.ClientSid = cl.ClientSid
+	request.Client.ClientToken = cl.ClientPassword
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	response, err := AuthClient.ServiceClient.Create(ctx, &request)
+	client, err := s.Client()
 
 	if err != nil {
 		return err
 	}
 
-	if response.Status != pb.ResponseCode_OK {
-		log.Errorln("Failure Creating Application Client", response.Error)
-		return errors.New("Failure Creating Application Client" + response.Error)
-	} else {
-		cl.ClientPassword = response.Client.ClientToken
-		cl.DateCreated = response.Client.DateCreated.Format(time.ANSIC)
-		cl.DateUpdated = response.Client.DateUpdated.Format(time.ANSIC)
-	}
+	// Create is not idempotent, never retried here, callers guard it with idempotency keys
+	return s.invoke(ctx, s.config.Timeouts.Create, false, func(ctx context.Context) error {
+
+		response, err := client.Create(ctx, &request)
+
+		if err != nil {
+			return err
+		}
+
+		if response.Status != pb.ResponseCode_OK {
+			log.Errorln("Failure Creating Application Client", response.Error)
+			return errors.New("Failure Creating Application Client" + response.Error)
+		} else if len(cl.ClientPassword) > 0 && response.Client.ClientToken != cl.ClientPassword {
+			log.Errorln("ServiceAuth issued a new password for ", cl.ClientSid, " instead of keeping it")
+			return errors.New("Failure Updating Application Client, password not kept")
+		} else {
+			cl.ClientPassword = response.Client.ClientToken
+			cl.DateCreated = response.Client.DateCreated.Format(time.ANSIC)
+			cl.DateUpdated = response.Client.DateUpdated.Format(time.ANSIC)
+			cl.Ttl = response.Client.Ttl
+			cl.ExpiresAt = ClientExpiresAt(response.Client)
+		}
 
-	return nil
+		return nil
+	})
 
 }
 
-func GetClientBySID(csid string) (Client, error) {
+func (s *ServiceAuth) GetClientBySID(ctx context.Context, csid string) (Client, error) {
 
 	log.Infoln("Get App client by ClienSid grpc call... ")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := AuthClient.ServiceClient.GetClientByClientSid(ctx, &pb.ClientId{ClientSid: csid})
+	client, err := s.Client()
 
 	if err != nil {
 		return Client{}, err
@@ -78,21 +111,38 @@ func GetClientBySID(csid string) (Client, error) {
 
 	var c Client
 
-	if resp.Status != pb.ResponseCode_OK {
+	err = s.invoke(ctx, s.config.Timeouts.Get, true, func(ctx context.Context) error {
 
-		return Client{}, errors.New("Application Error " + resp.Err)
-	} else {
+		resp, err := client.GetClientByClientSid(ctx, &pb.ClientId{ClientSid: csid})
 
-		for _, cl := range resp.Clients {
-			c.AccountSid = cl.AccountSid
-			c.ApplicationSid = cl.ApplicationSid
-			c.ClientSid = cl.ClientSid
-			c.ClientPassword = cl.ClientToken
-			c.DateCreated = cl.DateCreated.Format(time.ANSIC)
-			c.DateUpdated = cl.DateUpdated.Format(time.ANSIC)
-			c.Nickname = cl.Nickname
-			c.PresenceStatus = cl.Presence
+		// Unknown clients come back empty, like from the local stores
+		if status.Code(err) == codes.NotFound {
+			return nil
 		}
+
+		if err != nil {
+			return err
+		}
+
+		if resp.Status != pb.ResponseCode_OK && strings.Contains(strings.ToLower(resp.Err), "not found") {
+			return nil
+		}
+
+		if resp.Status != pb.ResponseCode_OK {
+
+			return errors.New("Application Error " + resp.Err)
+		} else {
+
+			for _, cl := range resp.Clients {
+				c = ClientFromPb(c, cl)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return Client{}, err
 	}
 
 	return c, nil
@@ -100,9 +150,10 @@ func GetClientBySID(csid string) (Client, error) {
 
 /*
 	Args: preinitialized Client struct ,page , pageSize
+	An empty ApplicationSid lists clients across all applications of the account
 	Returns : Client slice,total record count , grpc service/client error
 */
-func ListAppClients(c Client, page int32, pageSize int32) ([]Client, int64, error) {
+func (s *ServiceAuth) ListAppClients(ctx context.Context, c Client, page int32, pageSize int32) ([]Client, int64, error) {
 	log.Infoln("List All Application Clients grpc call... ")
 
 	var offset int32
@@ -114,46 +165,144 @@ func ListAppClients(c Client, page int32, pageSize int32) ([]Client, int64, erro
 		offset = page * pageSize
 	}
 
+	clients, totalCount, err := s.fetchAppClients(ctx, c, offset, pageSize)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ClientArr []Client
+
+	for _, client := range clients {
+		ClientArr = append(ClientArr, ClientFromPb(c, client))
+	}
+
+	return ClientArr, totalCount, nil
+
+}
+
+/*
+	Lists clients keeping only those whose expiry state matches expired.
+	ServiceAuth can't filter on expiry, so the listing is read in batches
+	and only the requested page of matching clients is kept
+	Returns : Client slice,filtered record count , grpc service/client error
+*/
+func (s *ServiceAuth) ListAppClientsByExpiry(ctx context.Context, c Client, expired bool, page int32, pageSize int32) ([]Client, int64, error) {
+	log.Infoln("List Application Clients by expiry grpc call... ")
+
+	p := newClientPager(&expired, pageOffset(page, pageSize), int64(pageSize))
+
+	var offset int32
+
+	for {
+		clients, totalCount, err := s.fetchAppClients(ctx, c, offset, listBatchSize)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, client := range clients {
+			p.Add(client)
+		}
+
+		offset += int32(len(clients))
+
+		if len(clients) == 0 || int64(offset) >= totalCount {
+			break
+		}
+	}
+
+	var matched []Client
+
+	for _, client := range p.page {
+		matched = append(matched, ClientFromPb(c, client))
+	}
+
+	return matched, p.total, nil
+}
+
+func (s *ServiceAuth) fetchAppClients(ctx context.Context, c Client, offset int32, limit int32) ([]*pb.Client, int64, error) {
+
 	in := &pb.FetchInputFields{
 		AccountSid:     c.AccountSid,
 		ApplicationSid: c.ApplicationSid,
 		Offset:         offset,
-		Limit:          pageSize,
+		Limit:          limit,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := AuthClient.ServiceClient.GetClientListByFetchFields(ctx, in)
+	client, err := s.Client()
 
 	if err != nil {
 		return nil, 0, err
 	}
 
-	var ClientArr []Client
+	var clients []*pb.Client
+	var totalCount int64
 
-	if resp.Status != pb.ResponseCode_OK {
+	err = s.invoke(ctx, s.config.Timeouts.List, true, func(ctx context.Context) error {
 
-		return nil, 0, errors.New("Application Error " + resp.Err)
+		resp, err := client.GetClientListByFetchFields(ctx, in)
 
-	} else {
+		if err != nil {
+			return err
+		}
 
-		for _, client := range resp.Clients {
-			c.ClientSid = client.ClientSid
-			c.ClientPassword = client.ClientToken
-			c.DateCreated = client.DateCreated.Format(time.ANSIC)
-			c.DateUpdated = client.DateUpdated.Format(time.ANSIC)
-			c.Nickname = client.Nickname
-			c.PresenceStatus = client.Presence
-			ClientArr = append(ClientArr, c)
+		if resp.Status != pb.ResponseCode_OK {
+			return errors.New("Application Error " + resp.Err)
 		}
+
+		clients, totalCount = resp.Clients, resp.TotalCount
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return clients, totalCount, nil
+}
+
+/*
+	Copies the ServiceAuth client onto a preinitialized Client
+	keeping its request fields (Uri, ApiVersion, RemoteIp ...)
+*/
+func ClientFromPb(c Client, cl *pb.Client) Client {
+	c.AccountSid = cl.AccountSid
+	c.ApplicationSid = cl.ApplicationSid
+	c.ClientSid = cl.ClientSid
+	c.ClientPassword = cl.ClientToken
+	c.DateCreated = cl.DateCreated.Format(time.ANSIC)
+	c.DateUpdated = cl.DateUpdated.Format(time.ANSIC)
+	c.Nickname = cl.Nickname
+	c.PresenceStatus = cl.Presence
+	c.Ttl = cl.Ttl
+	c.ExpiresAt = ClientExpiresAt(cl)
+	return c
+}
+
+/*
+	Ttl counts in seconds from the last update of the client, zero never expires
+*/
+func ClientExpiresAt(cl *pb.Client) string {
+
+	if cl.Ttl <= 0 {
+		return ""
 	}
 
-	return ClientArr, resp.TotalCount, nil
+	return cl.DateUpdated.Add(time.Duration(cl.Ttl) * time.Second).Format(time.ANSIC)
+}
+
+func ClientExpired(cl *pb.Client, now time.Time) bool {
 
+	if cl.Ttl <= 0 {
+		return false
+	}
+
+	return now.After(cl.DateUpdated.Add(time.Duration(cl.Ttl) * time.Second))
 }
 
-func DeleteClients(csid string) error {
+func (s *ServiceAuth) DeleteClients(ctx context.Context, csid string) error {
 	log.Infoln("DeleteClients grpc call... ")
 
 	id := &pb.ClientId{ClientSid: csid}
@@ -162,18 +311,24 @@ func DeleteClients(csid string) error {
 
 	cids.ClientSids = append(cids.ClientSids, id)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := AuthClient.ServiceClient.DeleteClientsWithCheck(ctx, &cids)
+	client, err := s.Client()
 
 	if err != nil {
 		return err
 	}
 
-	if resp.Status != pb.ResponseCode_OK {
-		return errors.New(resp.Err)
-	}
+	return s.invoke(ctx, s.config.Timeouts.Delete, false, func(ctx context.Context) error {
+
+		resp, err := client.DeleteClientsWithCheck(ctx, &cids)
+
+		if err != nil {
+			return err
+		}
+
+		if resp.Status != pb.ResponseCode_OK {
+			return errors.New(resp.Err)
+		}
 
-	return nil
+		return nil
+	})
 }
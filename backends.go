@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+)
+
+const backendsScheme = "serviceauth"
+
+/*
+	Resolves the ServiceAuth endpoints, a comma separated list of host:port
+	where each host may be a DNS name with several addresses, and feeds
+	them to the gRPC balancer. Backends failing OutlierFailures calls in a row
+	are left out for OutlierEjectTime, never all of them at once
+*/
+type Backends struct {
+	endpoints []string
+	config    ServiceAuthConfig
+
+	mu       sync.Mutex
+	cc       resolver.ClientConn
+	addrs    []string
+	hosts    map[string]string
+	failures map[string]int
+	ejected  map[string]time.Time
+}
+
+func NewBackends(cfg ServiceAuthConfig) *Backends {
+
+	b := &Backends{
+		config:   cfg,
+		hosts:    make(map[string]string),
+		failures: make(map[string]int),
+		ejected:  make(map[string]time.Time),
+	}
+
+	for _, e := range strings.Split(cfg.Endpoint, ",") {
+		if e = strings.TrimPrefix(strings.TrimSpace(e), "dns:///"); len(e) > 0 {
+			b.endpoints = append(b.endpoints, e)
+		}
+	}
+
+	return b
+}
+
+/*
+	Authority presented to the backends
+*/
+func (b *Backends) Authority() string {
+	if len(b.endpoints) == 0 {
+		return ""
+	}
+	return b.endpoints[0]
+}
+
+/*
+	Host of the endpoint a backend address was resolved from, empty for unknown addresses
+*/
+func (b *Backends) Host(addr string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.hosts[addr]
+}
+
+func (b *Backends) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+
+	b.mu.Lock()
+	b.cc = cc
+	b.mu.Unlock()
+
+	b.resolve()
+
+	return b, nil
+}
+
+func (b *Backends) Scheme() string {
+	return backendsScheme
+}
+
+func (b *Backends) ResolveNow(resolver.ResolveNowOptions) {
+	go b.resolve()
+}
+
+func (b *Backends) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cc = nil
+}
+
+/*
+	Re-resolves the endpoints and lifts expired ejections until ctx is done
+*/
+func (b *Backends) Refresh(ctx context.Context, every time.Duration) {
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.resolve()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Backends) resolve() {
+
+	var addrs []string
+	hosts := make(map[string]string)
+
+	for _, e := range b.endpoints {
+		host, port, err := net.SplitHostPort(e)
+
+		if err != nil {
+			log.Errorln("Invalid Service Auth endpoint ", e, " -", err.Error())
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupHost(context.Background(), host)
+
+		if err != nil {
+			log.Errorln("Error resolving Service Auth endpoint ", e, " -", err.Error())
+			continue
+		}
+
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, port)
+			addrs = append(addrs, addr)
+			hosts[addr] = host
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Keep the last known backends while DNS is failing
+	if len(addrs) > 0 {
+		sort.Strings(addrs)
+		b.addrs = addrs
+		b.hosts = hosts
+	}
+
+	b.push()
+}
+
+/*
+	Sends the non ejected backends to the balancer, called with mu held
+*/
+func (b *Backends) push() {
+
+	if b.cc == nil || len(b.addrs) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	var healthy []resolver.Address
+
+	for _, a := range b.addrs {
+		if until, ok := b.ejected[a]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(b.ejected, a)
+			log.Infoln("Service Auth backend ", a, " back from ejection")
+		}
+		healthy = append(healthy, resolver.Address{Addr: a})
+	}
+
+	// Ejecting every backend would turn a partial outage into a full one
+	if len(healthy) == 0 {
+		for _, a := range b.addrs {
+			healthy = append(healthy, resolver.Address{Addr: a})
+		}
+	}
+
+	// Health checking per backend needs a policy that supports it, pick_first ignores it
+	config := b.cc.ParseServiceConfig(`{"loadBalancingConfig":[{"` + b.config.LbPolicy + `":{}}],"healthCheckConfig":{"serviceName":""}}`)
+
+	if err := b.cc.UpdateState(resolver.State{Addresses: healthy, ServiceConfig: config}); err != nil {
+		log.Errorln("Error updating Service Auth backends ", err.Error())
+	}
+}
+
+/*
+	Counts consecutive transport failures per backend, ejects outliers
+*/
+func (b *Backends) Record(addr string, err error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !breakerFailure(err) {
+		delete(b.failures, addr)
+		return
+	}
+
+	b.failures[addr]++
+
+	if b.failures[addr] < b.config.OutlierFailures {
+		return
+	}
+
+	delete(b.failures, addr)
+	b.ejected[addr] = time.Now().Add(b.config.OutlierEjectTime)
+
+	log.Warnln("Ejecting Service Auth backend ", addr, " for ", b.config.OutlierEjectTime)
+
+	b.push()
+}
+
+/*
+	Backends currently resolved and ejected
+*/
+func (b *Backends) Status() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ejected := 0
+	now := time.Now()
+
+	for _, until := range b.ejected {
+		if now.Before(until) {
+			ejected++
+		}
+	}
+
+	return len(b.addrs), ejected
+}
+
+/*
+	Attributes each call's outcome to the backend that served it
+*/
+func (b *Backends) UnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	var p peer.Peer
+
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Peer(&p))...)
+
+	if p.Addr != nil {
+		b.Record(p.Addr.String(), err)
+	}
+
+	return err
+}
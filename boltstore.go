@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltClientsBucket = []byte("clients")
+	boltIndexBucket   = []byte("index")
+)
+
+/*
+	ClientStore in an embedded bbolt file, lets the REST API run without ServiceAuth.
+	Clients are stored as JSON by ClientSid, the index bucket holds
+	AccountSid/ApplicationSid/ClientSid keys so listings only scan one account
+*/
+type BoltClientStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltClientStore(path string) (*BoltClientStore, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltClientsBucket, boltIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Infoln("Serving clients from local store ", path)
+
+	return &BoltClientStore{db: db}, nil
+}
+
+func boltIndexKey(r *pb.Client) []byte {
+	return []byte(r.AccountSid + "/" + r.ApplicationSid + "/" + r.ClientSid)
+}
+
+func boltGet(tx *bolt.Tx, csid string) (*pb.Client, error) {
+
+	v := tx.Bucket(boltClientsBucket).Get([]byte(csid))
+
+	if v == nil {
+		return nil, nil
+	}
+
+	var r pb.Client
+
+	if err := json.Unmarshal(v, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func boltDelete(tx *bolt.Tx, r *pb.Client) error {
+
+	if err := tx.Bucket(boltIndexBucket).Delete(boltIndexKey(r)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltClientsBucket).Delete([]byte(r.ClientSid))
+}
+
+func (b *BoltClientStore) Create(ctx context.Context, cl *Client, ttl string) error {
+
+	if len(cl.ClientSid) == 0 {
+		return errors.New("Missing ClientSid")
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+
+		existing, err := boltGet(tx, cl.ClientSid)
+
+		if err != nil {
+			return err
+		}
+
+		// The client may move to another application, drop its old index entry
+		if existing != nil {
+			if err := tx.Bucket(boltIndexBucket).Delete(boltIndexKey(existing)); err != nil {
+				return err
+			}
+		}
+
+		r := newClientRecord(cl, ttl, existing, time.Now())
+
+		data, err := json.Marshal(r)
+
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltClientsBucket).Put([]byte(r.ClientSid), data); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltIndexBucket).Put(boltIndexKey(r), nil); err != nil {
+			return err
+		}
+
+		*cl = ClientFromPb(*cl, r)
+
+		return nil
+	})
+}
+
+func (b *BoltClientStore) Get(ctx context.Context, csid string) (Client, error) {
+
+	var c Client
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+
+		r, err := boltGet(tx, csid)
+
+		if err != nil || r == nil {
+			return err
+		}
+
+		c = ClientFromPb(c, r)
+
+		return nil
+	})
+
+	return c, err
+}
+
+func (b *BoltClientStore) List(ctx context.Context, c Client, expired *bool, page int32, pageSize int32) ([]Client, int64, error) {
+
+	prefix := []byte(c.AccountSid + "/")
+
+	if len(c.ApplicationSid) > 0 {
+		prefix = []byte(c.AccountSid + "/" + c.ApplicationSid + "/")
+	}
+
+	// The prefix selects the account and application, index keys end with
+	// the ClientSid so the cursor walks them in listing order
+	p := newClientPager(expired, pageOffset(page, pageSize), int64(pageSize))
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+
+		cur := tx.Bucket(boltIndexBucket).Cursor()
+
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+
+			r, err := boltGet(tx, string(k[bytes.LastIndexByte(k, '/')+1:]))
+
+			if err != nil {
+				return err
+			}
+
+			if r != nil {
+				p.Add(r)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var clients []Client
+
+	for _, r := range p.page {
+		clients = append(clients, ClientFromPb(c, r))
+	}
+
+	return clients, p.total, nil
+}
+
+func (b *BoltClientStore) Delete(ctx context.Context, csid string) error {
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+
+		r, err := boltGet(tx, csid)
+
+		if err != nil {
+			return err
+		}
+
+		if r == nil {
+			return errors.New("Client " + csid + " not found")
+		}
+
+		return boltDelete(tx, r)
+	})
+}
+
+func (b *BoltClientStore) Ready() bool {
+	return true
+}
+
+/*
+	Deletes clients whose Ttl ran out more than retention ago
+*/
+func (b *BoltClientStore) Expire(every time.Duration, retention time.Duration) {
+
+	for now := range time.Tick(every) {
+		if err := b.expire(now, retention); err != nil {
+			log.Errorln("Error expiring local clients ", err.Error())
+		}
+	}
+}
+
+func (b *BoltClientStore) expire(now time.Time, retention time.Duration) error {
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+
+		var stale []*pb.Client
+
+		err := tx.Bucket(boltClientsBucket).ForEach(func(k, v []byte) error {
+			var r pb.Client
+
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			if ClientExpired(&r, now.Add(-retention)) {
+				stale = append(stale, &r)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// Buckets can't be modified while ForEach walks them
+		for _, r := range stale {
+			if err := boltDelete(tx, r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *BoltClientStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBoltStore(t *testing.T) *BoltClientStore {
+	t.Helper()
+
+	store, err := OpenBoltClientStore(filepath.Join(t.TempDir(), "clients.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+/*
+	Index keys held for a ClientSid
+*/
+func boltIndexKeys(t *testing.T, store *BoltClientStore, csid string) []string {
+	t.Helper()
+
+	var keys []string
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexBucket).ForEach(func(k, v []byte) error {
+			if filepath.Base(string(k)) == csid {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func boltCreate(t *testing.T, store *BoltClientStore, accSid string, appSid string, csid string, ttl string) {
+	t.Helper()
+
+	if err := store.Create(context.Background(), &Client{AccountSid: accSid, ApplicationSid: appSid, ClientSid: csid}, ttl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func boltListSids(t *testing.T, store *BoltClientStore, accSid string, appSid string) []string {
+	t.Helper()
+
+	clients, total, err := store.List(context.Background(), Client{AccountSid: accSid, ApplicationSid: appSid}, nil, 0, 50)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int(total) != len(clients) {
+		t.Fatalf("total %v for %v clients", total, len(clients))
+	}
+
+	var sids []string
+
+	for _, c := range clients {
+		sids = append(sids, c.ClientSid)
+	}
+
+	return sids
+}
+
+func TestBoltStoreListByIndexPrefix(t *testing.T) {
+
+	const (
+		otherAccountSid = "AC00000000000000000000000000000002"
+		otherAppSid     = "AP00000000000000000000000000000002"
+	)
+
+	store := openTestBoltStore(t)
+
+	boltCreate(t, store, testAccountSid, testAppSid, "GT00000000000000000000000000000001", "")
+	boltCreate(t, store, testAccountSid, testAppSid, "GT00000000000000000000000000000002", "")
+	boltCreate(t, store, testAccountSid, otherAppSid, "GT00000000000000000000000000000003", "")
+	boltCreate(t, store, otherAccountSid, testAppSid, "GT00000000000000000000000000000004", "")
+
+	for _, tc := range []struct {
+		accSid string
+		appSid string
+		want   []string
+	}{
+		{testAccountSid, testAppSid, []string{"GT00000000000000000000000000000001", "GT00000000000000000000000000000002"}},
+		{testAccountSid, otherAppSid, []string{"GT00000000000000000000000000000003"}},
+		{testAccountSid, "", []string{"GT00000000000000000000000000000001", "GT00000000000000000000000000000002", "GT00000000000000000000000000000003"}},
+		{otherAccountSid, "", []string{"GT00000000000000000000000000000004"}},
+		{otherAccountSid, otherAppSid, nil},
+	} {
+		got := boltListSids(t, store, tc.accSid, tc.appSid)
+
+		if len(got) != len(tc.want) {
+			t.Errorf("%v/%v : got %v want %v", tc.accSid, tc.appSid, got, tc.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v/%v : got %v want %v", tc.accSid, tc.appSid, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBoltStoreMoveClientBetweenApplications(t *testing.T) {
+
+	const otherAppSid = "AP00000000000000000000000000000002"
+
+	store := openTestBoltStore(t)
+
+	boltCreate(t, store, testAccountSid, testAppSid, testClientSid, "")
+	boltCreate(t, store, testAccountSid, otherAppSid, testClientSid, "")
+
+	if got := boltListSids(t, store, testAccountSid, testAppSid); len(got) != 0 {
+		t.Fatalf("client still listed in its old application : %v", got)
+	}
+
+	if got := boltListSids(t, store, testAccountSid, otherAppSid); len(got) != 1 || got[0] != testClientSid {
+		t.Fatalf("client not listed in its new application : %v", got)
+	}
+
+	want := testAccountSid + "/" + otherAppSid + "/" + testClientSid
+
+	if keys := boltIndexKeys(t, store, testClientSid); len(keys) != 1 || keys[0] != want {
+		t.Fatalf("index keys %v want %v", keys, want)
+	}
+}
+
+func TestBoltStoreExpire(t *testing.T) {
+
+	const expiringSid = "GT00000000000000000000000000000002"
+
+	store := openTestBoltStore(t)
+
+	boltCreate(t, store, testAccountSid, testAppSid, testClientSid, "")
+	boltCreate(t, store, testAccountSid, testAppSid, expiringSid, "60")
+
+	// Expired, but still within the retention
+	if err := store.expire(time.Now().Add(2*time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, _ := store.Get(context.Background(), expiringSid); len(c.ClientSid) == 0 {
+		t.Fatal("client deleted within the retention")
+	}
+
+	if err := store.expire(time.Now().Add(2*time.Minute), time.Minute/2); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, _ := store.Get(context.Background(), expiringSid); len(c.ClientSid) > 0 {
+		t.Fatal("expired client kept past the retention")
+	}
+
+	if keys := boltIndexKeys(t, store, expiringSid); len(keys) > 0 {
+		t.Fatalf("index keys of the expired client kept : %v", keys)
+	}
+
+	if got := boltListSids(t, store, testAccountSid, testAppSid); len(got) != 1 || got[0] != testClientSid {
+		t.Fatalf("client without a Ttl expired : %v", got)
+	}
+}
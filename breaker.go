@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var ErrCircuitOpen = errors.New("Service Auth circuit breaker open")
+
+// Values of the godrone_serviceauth_breaker_state gauge
+var breakerStateValues = map[string]float64{
+	BreakerClosed:   0,
+	BreakerHalfOpen: 1,
+	BreakerOpen:     2,
+}
+
+// First retry delay, doubled on each attempt
+const rpcRetryBackoff = 100 * time.Millisecond
+
+/*
+	Opens after a run of consecutive ServiceAuth failures and short-circuits calls
+	until the open timeout passes, then lets a single trial call through.
+	Only transport level failures count, application errors mean ServiceAuth is up
+*/
+type CircuitBreaker struct {
+	mu          sync.Mutex
+	state       string
+	failures    int
+	threshold   int
+	openTimeout time.Duration
+	openedAt    time.Time
+	trial       bool
+}
+
+func NewCircuitBreaker(threshold int, openTimeout time.Duration) *CircuitBreaker {
+
+	breakerState.Set(breakerStateValues[BreakerClosed])
+
+	return &CircuitBreaker{
+		state:       BreakerClosed,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+	}
+}
+
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return nil
+
+	case BreakerHalfOpen:
+		// One trial call at a time decides between closing and reopening
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+
+	return nil
+}
+
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+
+	if !breakerFailure(err) {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+/*
+	Ends a call without an outcome, a half-open breaker lets the next trial through
+*/
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	if b.state != state {
+		log.Warnln("Service Auth circuit breaker ", b.state, " -> ", state)
+		breakerTransitions.WithLabelValues(b.state, state).Inc()
+		breakerState.Set(breakerStateValues[state])
+		b.state = state
+	}
+}
+
+func breakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+/*
+	Runs a ServiceAuth call through the circuit breaker. Idempotent calls are
+	retried on Unavailable with jittered exponential backoff, within the request context.
+	Calls ended by the request context being canceled or running out don't count
+*/
+func (s *ServiceAuth) invoke(ctx context.Context, timeout time.Duration, idempotent bool, call func(context.Context) error) error {
+
+	attempts := 1
+	if idempotent {
+		attempts = s.config.RetryAttempts
+	}
+
+	backoff := rpcRetryBackoff
+
+	for attempt := 1; ; attempt++ {
+
+		if err := s.breaker.Allow(); err != nil {
+			return err
+		}
+
+		callCtx, cancel := rpcContext(ctx, timeout)
+		err := call(callCtx)
+		cancel()
+
+		// A caller gone or out of time says nothing about ServiceAuth
+		if ctx.Err() != nil {
+			s.breaker.Release()
+			return err
+		}
+
+		s.breaker.Record(err)
+
+		if err == nil || status.Code(err) != codes.Unavailable || attempt >= attempts {
+			return err
+		}
+
+		log.Warnln("Service Auth unavailable, retrying attempt ", attempt+1, " -", err.Error())
+
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+	}
+}
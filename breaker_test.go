@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+
+	b := NewCircuitBreaker(2, time.Millisecond)
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	opened := testutil.ToFloat64(breakerTransitions.WithLabelValues(BreakerClosed, BreakerOpen))
+
+	b.Record(unavailable)
+
+	if got := testutil.ToFloat64(breakerState); got != 0 {
+		t.Fatalf("state %v after one failure, want closed", got)
+	}
+
+	b.Record(unavailable)
+
+	if got := testutil.ToFloat64(breakerState); got != 2 {
+		t.Fatalf("state %v after threshold, want open", got)
+	}
+
+	if got := testutil.ToFloat64(breakerTransitions.WithLabelValues(BreakerClosed, BreakerOpen)); got != opened+1 {
+		t.Fatalf("closed -> open transitions %v want %v", got, opened+1)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(breakerState); got != 1 {
+		t.Fatalf("state %v after open timeout, want half-open", got)
+	}
+
+	b.Record(nil)
+
+	if got := testutil.ToFloat64(breakerState); got != 0 {
+		t.Fatalf("state %v after a successful trial, want closed", got)
+	}
+}
+
+func TestCircuitBreakerIgnoresCallerContext(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.ServiceAuth.BreakerFailures = 1
+	cfg.ServiceAuth.BreakerOpenTimeout = time.Millisecond
+	cfg.ServiceAuth.RetryAttempts = 1
+
+	auth := NewServiceAuth(cfg)
+
+	// Waits for the caller's context, as a slow ServiceAuth call does
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	// Deadline of the request, not of ServiceAuth
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := auth.invoke(ctx, time.Minute, true, slow); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v want DeadlineExceeded", err)
+	}
+
+	if got := auth.breaker.State(); got != BreakerClosed {
+		t.Fatalf("breaker %v after the caller's deadline, want closed", got)
+	}
+
+	// Open, then half-open with its trial call canceled by the client going away
+	auth.breaker.Record(status.Error(codes.Unavailable, "down"))
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	err := auth.invoke(ctx, time.Minute, true, func(callCtx context.Context) error {
+		cancel()
+		return slow(callCtx)
+	})
+
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("got %v want Canceled", err)
+	}
+
+	if got := auth.breaker.State(); got != BreakerHalfOpen {
+		t.Fatalf("breaker %v after a canceled trial, want half-open", got)
+	}
+
+	if err := auth.breaker.Allow(); err != nil {
+		t.Fatalf("next trial refused after a canceled one : %v", err)
+	}
+}
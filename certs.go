@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Holds a certificate/key pair and optionally a CA bundle loaded from disk.
+	Watch reloads them when a file changes, handshakes pick up the new
+	material through the Get* callbacks without restarting connections
+*/
+type CertReloader struct {
+	sync.RWMutex
+
+	certFile string
+	keyFile  string
+	caFile   string
+
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	modTime time.Time
+}
+
+/*
+	Any of the files may be empty, cert and key go together
+*/
+func NewCertReloader(certFile string, keyFile string, caFile string) (*CertReloader, error) {
+
+	if (len(certFile) > 0) != (len(keyFile) > 0) {
+		return nil, errors.New("Certificate and key files must be set together")
+	}
+
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	if err := r.Load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *CertReloader) Load() error {
+
+	var cert *tls.Certificate
+	var roots *x509.CertPool
+
+	if len(r.certFile) > 0 {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+		if err != nil {
+			return err
+		}
+
+		cert = &pair
+	}
+
+	if len(r.caFile) > 0 {
+		data, err := ioutil.ReadFile(r.caFile)
+
+		if err != nil {
+			return err
+		}
+
+		roots = x509.NewCertPool()
+
+		if !roots.AppendCertsFromPEM(data) {
+			return errors.New("No CA certificates found in " + r.caFile)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.cert = cert
+	r.roots = roots
+	r.modTime = r.lastModified()
+
+	return nil
+}
+
+/*
+	Keeps serving the previous material when a reload fails,
+	a half written file is picked up on the next tick
+*/
+func (r *CertReloader) Watch(every time.Duration) {
+
+	for range time.Tick(every) {
+
+		r.RLock()
+		changed := r.lastModified().After(r.modTime)
+		r.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := r.Load(); err != nil {
+			log.Errorln("Error reloading certificates ", err.Error())
+			continue
+		}
+
+		log.Infoln("Reloaded certificates ", r.certFile, " ", r.caFile)
+	}
+}
+
+func (r *CertReloader) lastModified() time.Time {
+
+	var latest time.Time
+
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if len(f) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.cert == nil {
+		return nil, errors.New("No certificate loaded")
+	}
+
+	return r.cert, nil
+}
+
+/*
+	Without a client certificate an empty one is sent and the server decides
+*/
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return r.cert, nil
+}
+
+/*
+	nil means the system roots
+*/
+func (r *CertReloader) Roots() *x509.CertPool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.roots
+}
+
+/*
+	Client side TLS config verifying the peer against the current CA bundle and serverName.
+	Verification is done by hand since tls.Config.RootCAs can't change after dial.
+	The hostname is checked against serverName, not the SNI, which is empty for IP addresses
+*/
+func (r *CertReloader) ClientTLSConfig(serverName string) *tls.Config {
+
+	return &tls.Config{
+		ServerName:           serverName,
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: r.GetClientCertificate,
+		InsecureSkipVerify:   true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("No server certificate presented")
+			}
+
+			if len(serverName) == 0 {
+				return errors.New("No server name to verify the certificate against")
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         r.Roots(),
+				Intermediates: x509.NewCertPool(),
+			}
+
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+	CA file and a server certificate it signed, valid for dnsName only
+*/
+func testServerCert(t *testing.T, dnsName string) (string, tls.Certificate) {
+	t.Helper()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return caFile, tls.Certificate{Certificate: [][]byte{leafDer}, PrivateKey: key}
+}
+
+func TestClientTLSConfigVerifiesServerName(t *testing.T) {
+
+	caFile, cert := testServerCert(t, "serviceauth.test")
+
+	certs, err := NewCertReloader("", "", caFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	for serverName, ok := range map[string]bool{
+		"serviceauth.test": true,
+		"other.test":       false,
+		"127.0.0.1":        false,
+		"":                 false,
+	} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), certs.ClientTLSConfig(serverName))
+
+		if err == nil {
+			conn.Close()
+		}
+
+		if (err == nil) != ok {
+			t.Errorf("server name %q : handshake error %v", serverName, err)
+		}
+	}
+
+	if got := dialHost("10.0.0.1:8888"); got != "10.0.0.1" {
+		t.Errorf("dial host %v", got)
+	}
+}
+
+func TestBackendTLSVerifiesEachHost(t *testing.T) {
+
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	listeners := map[string]string{}
+
+	var cas []byte
+
+	for _, host := range []string{"a.serviceauth.test", "b.serviceauth.test"} {
+		caFile, cert := testServerCert(t, host)
+
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cas = append(cas, ca...)
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		listeners[host] = ln.Addr().String()
+	}
+
+	if err := os.WriteFile(bundle, cas, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := NewCertReloader("", "", bundle)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := NewBackends(ServiceAuthConfig{})
+	creds := &backendTLS{certs: certs, backends: backends}
+
+	handshake := func(addr string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// The channel authority is the first endpoint whatever backend is dialed
+		_, _, err = creds.ClientHandshake(context.Background(), "a.serviceauth.test:8888", conn)
+		return err
+	}
+
+	backends.hosts = map[string]string{
+		listeners["a.serviceauth.test"]: "a.serviceauth.test",
+		listeners["b.serviceauth.test"]: "b.serviceauth.test",
+	}
+
+	for host, addr := range listeners {
+		if err := handshake(addr); err != nil {
+			t.Errorf("backend of %v : %v", host, err)
+		}
+	}
+
+	// Resolved from the other endpoint, its certificate doesn't cover that host
+	backends.hosts = map[string]string{
+		listeners["b.serviceauth.test"]: "a.serviceauth.test",
+	}
+
+	if err := handshake(listeners["b.serviceauth.test"]); err == nil {
+		t.Error("backend verified against another endpoint's host")
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Service configuration. Sources in increasing precedence :
+	defaults, the YAML file (-config or CONFIG_FILE), env vars, command line flags.
+	Every setting has an env var and a flag, the flag being the lower cased
+	env name with dashes (GRPC_TIMEOUT_GET -> -grpc-timeout-get)
+*/
+type Config struct {
+	Addr            string        `yaml:"addr"`
+	LogLevel        string        `yaml:"log_level"`
+	LogFormat       string        `yaml:"log_format"`
+	PageSize        int64         `yaml:"page_size"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	AccountsMock    bool          `yaml:"accounts_mock"`
+
+	ZangRestURL  string        `yaml:"zang_rest_url"`
+	AuthCacheTtl time.Duration `yaml:"auth_cache_ttl"`
+
+	CertReloadInterval time.Duration `yaml:"cert_reload_interval"`
+
+	TLS         TLSConfig         `yaml:"tls"`
+	ServiceAuth ServiceAuthConfig `yaml:"service_auth"`
+	ClientStore ClientStoreConfig `yaml:"client_store"`
+
+	WebhookMaxAttempts int          `yaml:"webhook_max_attempts"`
+	Turn               TurnConfig   `yaml:"turn"`
+	JWT                JWTConfig    `yaml:"jwt"`
+	Digest             DigestConfig `yaml:"digest"`
+
+	VerifyCacheTtl time.Duration `yaml:"verify_cache_ttl"`
+	IdempotencyTtl time.Duration `yaml:"idempotency_ttl"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+}
+
+/*
+	HTTPS termination, served when both files are set
+*/
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	MinVersion   string `yaml:"min_version"`
+	CipherSuites string `yaml:"cipher_suites"`
+	RedirectAddr string `yaml:"redirect_addr"`
+}
+
+type ServiceAuthConfig struct {
+	Endpoint string `yaml:"endpoint"`
+
+	LbPolicy         string        `yaml:"lb_policy"`
+	ResolveInterval  time.Duration `yaml:"resolve_interval"`
+	OutlierFailures  int           `yaml:"outlier_failures"`
+	OutlierEjectTime time.Duration `yaml:"outlier_eject_time"`
+
+	Timeouts           RPCTimeouts   `yaml:"timeouts"`
+	RetryAttempts      int           `yaml:"retry_attempts"`
+	BreakerFailures    int           `yaml:"breaker_failures"`
+	BreakerOpenTimeout time.Duration `yaml:"breaker_open_timeout"`
+
+	TLS GRPCTLSConfig `yaml:"tls"`
+}
+
+/*
+	TLS towards ServiceAuth, enabled explicitly or by setting any of the files
+*/
+type GRPCTLSConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	CaFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
+type ClientStoreConfig struct {
+	Backend   string        `yaml:"backend"`
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type TurnConfig struct {
+	SharedSecret      string `yaml:"shared_secret"`
+	Uris              string `yaml:"uris"`
+	CredentialsTtl    int64  `yaml:"credentials_ttl"`
+	CredentialsMaxTtl int64  `yaml:"credentials_max_ttl"`
+}
+
+type JWTConfig struct {
+	KeysDir   string `yaml:"keys_dir"`
+	ActiveKid string `yaml:"active_kid"`
+	Issuer    string `yaml:"issuer"`
+	TokenTtl  int64  `yaml:"token_ttl"`
+}
+
+type DigestConfig struct {
+	Realm    string        `yaml:"realm"`
+	NonceTtl time.Duration `yaml:"nonce_ttl"`
+}
+
+/*
+	OTLP/gRPC trace export, disabled while Endpoint is empty
+*/
+type TracingConfig struct {
+	Endpoint    string `yaml:"endpoint"`
+	Insecure    bool   `yaml:"insecure"`
+	ServiceName string `yaml:"service_name"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:            ":8889",
+		LogLevel:        "info",
+		LogFormat:       "json",
+		PageSize:        50,
+		ShutdownTimeout: 30 * time.Second,
+
+		ZangRestURL:  "https://api.zang.io",
+		AuthCacheTtl: 10 * time.Minute,
+
+		CertReloadInterval: 1 * time.Minute,
+
+		TLS: TLSConfig{MinVersion: "1.2"},
+
+		ServiceAuth: ServiceAuthConfig{
+			Endpoint:           "localhost:8888",
+			LbPolicy:           "round_robin",
+			ResolveInterval:    30 * time.Second,
+			OutlierFailures:    5,
+			OutlierEjectTime:   30 * time.Second,
+			Timeouts:           RPCTimeouts{Create: 10 * time.Second, Get: 10 * time.Second, List: 10 * time.Second, Delete: 10 * time.Second},
+			RetryAttempts:      3,
+			BreakerFailures:    5,
+			BreakerOpenTimeout: 30 * time.Second,
+		},
+
+		ClientStore: ClientStoreConfig{
+			Backend:   ClientStoreServiceAuth,
+			Path:      "clients.db",
+			Retention: 24 * time.Hour,
+		},
+
+		WebhookMaxAttempts: 5,
+
+		Turn: TurnConfig{CredentialsTtl: 86400, CredentialsMaxTtl: 7 * 86400},
+		JWT:  JWTConfig{Issuer: "godrone", TokenTtl: 3600},
+
+		Digest: DigestConfig{Realm: "sip.zang.io", NonceTtl: 5 * time.Minute},
+
+		VerifyCacheTtl: 30 * time.Second,
+		IdempotencyTtl: 24 * time.Hour,
+
+		Tracing: TracingConfig{ServiceName: "godrone"},
+	}
+}
+
+type configVar struct {
+	env    string
+	ptr    interface{}
+	secret bool
+	reload bool
+}
+
+/*
+	Env var of each setting, flags are derived from the same table.
+	reload marks the settings a SIGHUP applies, the others need a restart
+*/
+func (c *Config) vars() []configVar {
+	return []configVar{
+		{env: "ADDR", ptr: &c.Addr},
+		{env: "LOG_LEVEL", ptr: &c.LogLevel, reload: true},
+		{env: "LOG_FORMAT", ptr: &c.LogFormat, reload: true},
+		{env: "PAGE_SIZE", ptr: &c.PageSize},
+		{env: "SHUTDOWN_TIMEOUT", ptr: &c.ShutdownTimeout},
+		{env: "ACCOUNTS_MOCK", ptr: &c.AccountsMock},
+		{env: "ZANG_REST_URL", ptr: &c.ZangRestURL},
+		{env: "AUTH_CACHE_TTL", ptr: &c.AuthCacheTtl, reload: true},
+		{env: "CERT_RELOAD_INTERVAL", ptr: &c.CertReloadInterval},
+
+		{env: "TLS_CERT_FILE", ptr: &c.TLS.CertFile},
+		{env: "TLS_KEY_FILE", ptr: &c.TLS.KeyFile},
+		{env: "TLS_MIN_VERSION", ptr: &c.TLS.MinVersion},
+		{env: "TLS_CIPHER_SUITES", ptr: &c.TLS.CipherSuites},
+		{env: "HTTP_REDIRECT_ADDR", ptr: &c.TLS.RedirectAddr},
+
+		{env: "GRPC_SERVICE_AUTH_ENDPOINT", ptr: &c.ServiceAuth.Endpoint},
+		{env: "GRPC_LB_POLICY", ptr: &c.ServiceAuth.LbPolicy},
+		{env: "GRPC_RESOLVE_INTERVAL", ptr: &c.ServiceAuth.ResolveInterval},
+		{env: "GRPC_OUTLIER_FAILURES", ptr: &c.ServiceAuth.OutlierFailures},
+		{env: "GRPC_OUTLIER_EJECT_TIME", ptr: &c.ServiceAuth.OutlierEjectTime},
+		{env: "GRPC_TIMEOUT_CREATE", ptr: &c.ServiceAuth.Timeouts.Create},
+		{env: "GRPC_TIMEOUT_GET", ptr: &c.ServiceAuth.Timeouts.Get},
+		{env: "GRPC_TIMEOUT_LIST", ptr: &c.ServiceAuth.Timeouts.List},
+		{env: "GRPC_TIMEOUT_DELETE", ptr: &c.ServiceAuth.Timeouts.Delete},
+		{env: "GRPC_RETRY_ATTEMPTS", ptr: &c.ServiceAuth.RetryAttempts},
+		{env: "BREAKER_FAILURES", ptr: &c.ServiceAuth.BreakerFailures},
+		{env: "BREAKER_OPEN_TIMEOUT", ptr: &c.ServiceAuth.BreakerOpenTimeout},
+		{env: "GRPC_TLS", ptr: &c.ServiceAuth.TLS.Enabled},
+		{env: "GRPC_TLS_CA_FILE", ptr: &c.ServiceAuth.TLS.CaFile},
+		{env: "GRPC_TLS_CERT_FILE", ptr: &c.ServiceAuth.TLS.CertFile},
+		{env: "GRPC_TLS_KEY_FILE", ptr: &c.ServiceAuth.TLS.KeyFile},
+		{env: "GRPC_TLS_SERVER_NAME", ptr: &c.ServiceAuth.TLS.ServerName},
+
+		{env: "CLIENT_STORE", ptr: &c.ClientStore.Backend},
+		{env: "CLIENT_STORE_PATH", ptr: &c.ClientStore.Path},
+		{env: "LOCAL_STORE_RETENTION", ptr: &c.ClientStore.Retention},
+
+		{env: "WEBHOOK_MAX_ATTEMPTS", ptr: &c.WebhookMaxAttempts, reload: true},
+
+		{env: "TURN_SHARED_SECRET", ptr: &c.Turn.SharedSecret, secret: true},
+		{env: "TURN_URIS", ptr: &c.Turn.Uris, reload: true},
+		{env: "CREDENTIALS_TTL", ptr: &c.Turn.CredentialsTtl, reload: true},
+		{env: "CREDENTIALS_MAX_TTL", ptr: &c.Turn.CredentialsMaxTtl, reload: true},
+
+		{env: "JWT_KEYS_DIR", ptr: &c.JWT.KeysDir},
+		{env: "JWT_ACTIVE_KID", ptr: &c.JWT.ActiveKid},
+		{env: "JWT_ISSUER", ptr: &c.JWT.Issuer},
+		{env: "TOKEN_TTL", ptr: &c.JWT.TokenTtl, reload: true},
+
+		// Outstanding nonces are bound to the realm they were issued for
+		{env: "DIGEST_REALM", ptr: &c.Digest.Realm},
+		{env: "DIGEST_NONCE_TTL", ptr: &c.Digest.NonceTtl, reload: true},
+
+		{env: "VERIFY_CACHE_TTL", ptr: &c.VerifyCacheTtl, reload: true},
+		{env: "IDEMPOTENCY_TTL", ptr: &c.IdempotencyTtl, reload: true},
+
+		{env: "TRACING_ENDPOINT", ptr: &c.Tracing.Endpoint},
+		{env: "TRACING_INSECURE", ptr: &c.Tracing.Insecure},
+		{env: "TRACING_SERVICE_NAME", ptr: &c.Tracing.ServiceName},
+	}
+}
+
+func flagName(env string) string {
+	return strings.Replace(strings.ToLower(env), "_", "-", -1)
+}
+
+func setConfigVar(ptr interface{}, value string) error {
+
+	var err error
+
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *int64:
+		*p, err = strconv.ParseInt(value, 10, 64)
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unsupported setting type %T", ptr)
+	}
+
+	return err
+}
+
+/*
+	Builds the configuration from all sources, args are the command line arguments
+*/
+func LoadConfig(args []string) (*Config, string, error) {
+
+	c := DefaultConfig()
+	vars := c.vars()
+
+	fs := flag.NewFlagSet("godrone", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+
+	flagValues := make(map[string]*string)
+
+	for _, v := range vars {
+		flagValues[v.env] = fs.String(flagName(v.env), "", "overrides "+v.env)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+
+	if len(*configFile) > 0 {
+		if err := c.loadFile(*configFile); err != nil {
+			return nil, *configFile, err
+		}
+	}
+
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v.env); ok {
+			if err := setConfigVar(v.ptr, value); err != nil {
+				return nil, *configFile, fmt.Errorf("Invalid %v : %v", v.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, v := range vars {
+			if f.Name == flagName(v.env) && flagErr == nil {
+				if err := setConfigVar(v.ptr, *flagValues[v.env]); err != nil {
+					flagErr = fmt.Errorf("Invalid -%v : %v", f.Name, err)
+				}
+			}
+		}
+	})
+
+	if flagErr != nil {
+		return nil, *configFile, flagErr
+	}
+
+	// Giving any TLS file turns TLS towards ServiceAuth on
+	if len(c.ServiceAuth.TLS.CaFile) > 0 || len(c.ServiceAuth.TLS.CertFile) > 0 {
+		c.ServiceAuth.TLS.Enabled = true
+	}
+
+	return c, *configFile, c.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("Invalid config file %v : %v", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) Validate() error {
+
+	var errs []string
+
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if len(c.Addr) == 0 {
+		fail("addr is required")
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		fail("log_level %v", err)
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		fail("log_format must be json or text")
+	}
+
+	if c.PageSize < 1 || c.PageSize > 1000 {
+		fail("page_size must be between 1 and 1000")
+	}
+
+	if (len(c.TLS.CertFile) > 0) != (len(c.TLS.KeyFile) > 0) {
+		fail("tls cert_file and key_file must be set together")
+	}
+
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		fail("tls min_version %v unsupported", c.TLS.MinVersion)
+	}
+
+	if len(c.TLS.CipherSuites) > 0 {
+		if _, err := cipherSuitesByName(strings.Split(c.TLS.CipherSuites, ",")); err != nil {
+			fail("tls cipher_suites %v", err)
+		}
+	}
+
+	if len(c.TLS.RedirectAddr) > 0 && len(c.TLS.CertFile) == 0 {
+		fail("tls redirect_addr requires HTTPS")
+	}
+
+	switch c.ClientStore.Backend {
+	case ClientStoreServiceAuth, ClientStoreBolt, ClientStoreMemory:
+	default:
+		fail("client_store backend %v unknown", c.ClientStore.Backend)
+	}
+
+	if c.ClientStore.Backend == ClientStoreServiceAuth && len(c.ServiceAuth.Endpoint) == 0 && !c.AccountsMock {
+		fail("service_auth endpoint is required")
+	}
+
+	if c.ServiceAuth.LbPolicy != "round_robin" && c.ServiceAuth.LbPolicy != "pick_first" {
+		fail("service_auth lb_policy must be round_robin or pick_first")
+	}
+
+	if (len(c.ServiceAuth.TLS.CertFile) > 0) != (len(c.ServiceAuth.TLS.KeyFile) > 0) {
+		fail("service_auth tls cert_file and key_file must be set together")
+	}
+
+	for name, n := range map[string]int{
+		"service_auth retry_attempts":   c.ServiceAuth.RetryAttempts,
+		"service_auth breaker_failures": c.ServiceAuth.BreakerFailures,
+		"service_auth outlier_failures": c.ServiceAuth.OutlierFailures,
+		"webhook_max_attempts":          c.WebhookMaxAttempts,
+	} {
+		if n < 1 {
+			fail("%v must be positive", name)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"shutdown_timeout":                  c.ShutdownTimeout,
+		"auth_cache_ttl":                    c.AuthCacheTtl,
+		"cert_reload_interval":              c.CertReloadInterval,
+		"service_auth resolve_interval":     c.ServiceAuth.ResolveInterval,
+		"service_auth outlier_eject_time":   c.ServiceAuth.OutlierEjectTime,
+		"service_auth timeouts create":      c.ServiceAuth.Timeouts.Create,
+		"service_auth timeouts get":         c.ServiceAuth.Timeouts.Get,
+		"service_auth timeouts list":        c.ServiceAuth.Timeouts.List,
+		"service_auth timeouts delete":      c.ServiceAuth.Timeouts.Delete,
+		"service_auth breaker_open_timeout": c.ServiceAuth.BreakerOpenTimeout,
+		"client_store retention":            c.ClientStore.Retention,
+		"digest nonce_ttl":                  c.Digest.NonceTtl,
+		"verify_cache_ttl":                  c.VerifyCacheTtl,
+		"idempotency_ttl":                   c.IdempotencyTtl,
+	} {
+		if d <= 0 {
+			fail("%v must be positive", name)
+		}
+	}
+
+	if c.Turn.CredentialsTtl <= 0 || c.Turn.CredentialsTtl > c.Turn.CredentialsMaxTtl {
+		fail("turn credentials_ttl must be positive and at most credentials_max_ttl")
+	}
+
+	if c.JWT.TokenTtl <= 0 || c.JWT.TokenTtl > tokenMaxTtl {
+		fail("jwt token_ttl must be between 1 and %v", tokenMaxTtl)
+	}
+
+	if len(c.Tracing.Endpoint) > 0 {
+		if _, _, err := net.SplitHostPort(c.Tracing.Endpoint); err != nil {
+			fail("tracing endpoint must be host:port")
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("Invalid configuration : " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+/*
+	Settings as env style lines, secrets redacted, for the boot log
+*/
+func (c *Config) Redacted() []string {
+
+	var lines []string
+
+	for _, v := range c.vars() {
+		value := fmt.Sprint(configValue(v.ptr))
+
+		if v.secret && len(value) > 0 {
+			value = "<redacted>"
+		}
+
+		lines = append(lines, v.env+"="+value)
+	}
+
+	return lines
+}
+
+func configValue(ptr interface{}) interface{} {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return *p
+	case *int64:
+		return *p
+	case *bool:
+		return *p
+	case *time.Duration:
+		return *p
+	}
+	return nil
+}
+
+/*
+	Configures logging. Reloadable settings are read from the server's
+	LiveConfig on every use, Server, ServiceAuth and stores take the Config itself
+*/
+func (c *Config) Apply() {
+	c.applyLogging()
+}
+
+/*
+	Access and request logs carry their fields as JSON, text is easier to read locally
+*/
+func (c *Config) applyLogging() {
+
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+
+	if c.LogFormat == "text" {
+		log.SetFormatter(&log.TextFormatter{})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+/*
+	Configuration currently in effect, swapped as a whole on reload
+*/
+type LiveConfig struct {
+	current atomic.Pointer[Config]
+}
+
+func NewLiveConfig(c *Config) *LiveConfig {
+	l := &LiveConfig{}
+	l.current.Store(c)
+	return l
+}
+
+func (l *LiveConfig) Load() *Config {
+	return l.current.Load()
+}
+
+/*
+	Re-reads all sources and applies the reloadable settings on top of the live
+	configuration. An invalid configuration is rejected and the running one kept,
+	changes to settings that need a restart are only reported
+*/
+func (l *LiveConfig) Reload(args []string) error {
+
+	next, _, err := LoadConfig(args)
+
+	if err != nil {
+		return err
+	}
+
+	current := l.Load()
+	updated := *current
+
+	curVars := current.vars()
+	nextVars := next.vars()
+	updVars := updated.vars()
+
+	changed := 0
+
+	for i, v := range curVars {
+		old := configValue(v.ptr)
+		value := configValue(nextVars[i].ptr)
+
+		if old == value {
+			continue
+		}
+
+		if !v.reload {
+			log.Warnln("Configuration ", v.env, " changed, restart required to apply it")
+			continue
+		}
+
+		copyConfigVar(updVars[i].ptr, nextVars[i].ptr)
+		changed++
+
+		if v.secret {
+			log.Infoln("Configuration ", v.env, " changed")
+		} else {
+			log.Infoln("Configuration ", v.env, " changed ", old, " -> ", value)
+		}
+	}
+
+	updated.applyLogging()
+
+	l.current.Store(&updated)
+
+	log.Infoln("Configuration reloaded, ", changed, " settings changed")
+
+	return nil
+}
+
+func copyConfigVar(dst interface{}, src interface{}) {
+	switch p := dst.(type) {
+	case *string:
+		*p = *src.(*string)
+	case *int:
+		*p = *src.(*int)
+	case *int64:
+		*p = *src.(*int64)
+	case *bool:
+		*p = *src.(*bool)
+	case *time.Duration:
+		*p = *src.(*time.Duration)
+	}
+}
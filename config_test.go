@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+
+	live := NewLiveConfig(DefaultConfig())
+	boot := live.Load()
+
+	t.Setenv("DIGEST_REALM", "reloaded.example.com")
+	t.Setenv("DIGEST_NONCE_TTL", "7m")
+
+	if err := live.Reload(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := live.Load()
+
+	if reloaded.Digest.Realm != boot.Digest.Realm {
+		t.Errorf("digest realm reloaded to %v, outstanding nonces would break", reloaded.Digest.Realm)
+	}
+
+	if reloaded.Digest.NonceTtl != 7*time.Minute {
+		t.Errorf("digest nonce ttl %v not reloaded", reloaded.Digest.NonceTtl)
+	}
+
+	t.Setenv("PAGE_SIZE", "0")
+
+	if err := live.Reload(nil); err == nil {
+		t.Error("invalid configuration accepted")
+	}
+
+	if live.Load() != reloaded {
+		t.Error("running configuration replaced by a rejected one")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+var ErrServiceAuthUnavailable = errors.New("Service Auth gRPC link not ready")
+
+/*
+	Owns the gRPC connection to ServiceAuth, balanced over its backends.
+	The connection is dialed without blocking, grpc reconnects with backoff
+	on failure and the monitor keeps an idle channel connecting so handlers
+	can fail fast on Ready instead of waiting on a dead link
+*/
+type ServiceAuth struct {
+	addr       string
+	config     ServiceAuthConfig
+	certReload time.Duration
+	breaker    *CircuitBreaker
+	backends   *Backends
+	mock       bool
+
+	mu     sync.RWMutex
+	conn   *grpc.ClientConn
+	client pb.ServiceAuthClient
+}
+
+func NewServiceAuth(cfg *Config) *ServiceAuth {
+	return &ServiceAuth{
+		addr:       cfg.ServiceAuth.Endpoint,
+		config:     cfg.ServiceAuth,
+		certReload: cfg.CertReloadInterval,
+		breaker:    NewCircuitBreaker(cfg.ServiceAuth.BreakerFailures, cfg.ServiceAuth.BreakerOpenTimeout),
+		backends:   NewBackends(cfg.ServiceAuth),
+	}
+}
+
+func (s *ServiceAuth) Connect(ctx context.Context) error {
+	if s.mock {
+		return nil
+	}
+
+	log.Infoln("Registering GRPC service auth client.. ", s.addr)
+
+	transport, err := s.transportCredentials()
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpc.Dial(backendsScheme+":///serviceauth",
+		transport,
+		grpc.WithResolvers(s.backends),
+		grpc.WithAuthority(s.backends.Authority()),
+		grpc.WithChainUnaryInterceptor(TracingUnaryInterceptor, MetricsUnaryInterceptor, s.backends.UnaryInterceptor),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 1 * time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 30 * time.Second},
+			MinConnectTimeout: 10 * time.Second,
+		}),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.client = pb.NewServiceAuthClient(conn)
+	s.mu.Unlock()
+
+	go s.monitor(ctx, conn)
+	go s.backends.Refresh(ctx, s.config.ResolveInterval)
+
+	return nil
+}
+
+/*
+	Plaintext unless TLS is configured, certificates and CA bundle are
+	reloaded from disk and apply to the next handshake
+*/
+func (s *ServiceAuth) transportCredentials() (grpc.DialOption, error) {
+
+	tlsConfig := s.config.TLS
+
+	if !tlsConfig.Enabled {
+		return grpc.WithInsecure(), nil
+	}
+
+	certs, err := NewCertReloader(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.CaFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	go certs.Watch(s.certReload)
+
+	log.Infoln("Using TLS for GRPC service auth, client certificate ", len(tlsConfig.CertFile) > 0)
+
+	// Server certificates must match GRPC_TLS_SERVER_NAME, or the host of their own endpoint
+	if len(tlsConfig.ServerName) > 0 {
+		return grpc.WithTransportCredentials(credentials.NewTLS(certs.ClientTLSConfig(tlsConfig.ServerName))), nil
+	}
+
+	return grpc.WithTransportCredentials(&backendTLS{
+		TransportCredentials: credentials.NewTLS(certs.ClientTLSConfig("")),
+		certs:                certs,
+		backends:             s.backends,
+	}), nil
+}
+
+/*
+	TLS verifying each backend against the endpoint host it was resolved from.
+	The authority of the channel is the first endpoint, it only names
+	backends the resolver doesn't know
+*/
+type backendTLS struct {
+	credentials.TransportCredentials
+	certs    *CertReloader
+	backends *Backends
+}
+
+func (c *backendTLS) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+
+	host := c.backends.Host(conn.RemoteAddr().String())
+
+	if len(host) == 0 {
+		host = dialHost(authority)
+	}
+
+	return credentials.NewTLS(c.certs.ClientTLSConfig(host)).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *backendTLS) Clone() credentials.TransportCredentials {
+	return &backendTLS{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		certs:                c.certs,
+		backends:             c.backends,
+	}
+}
+
+func dialHost(authority string) string {
+
+	host, _, err := net.SplitHostPort(authority)
+
+	if err != nil {
+		return authority
+	}
+
+	return host
+}
+
+func (s *ServiceAuth) monitor(ctx context.Context, conn *grpc.ClientConn) {
+
+	state := conn.GetState()
+
+	for {
+		if state == connectivity.Idle {
+			conn.Connect()
+		}
+
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+
+		next := conn.GetState()
+		log.Infoln("Service Auth connection state ", state, " -> ", next)
+
+		if next == connectivity.Shutdown {
+			return
+		}
+
+		state = next
+	}
+}
+
+func (s *ServiceAuth) State() connectivity.State {
+	if s.mock {
+		return connectivity.Ready
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.conn == nil {
+		return connectivity.Shutdown
+	}
+
+	return s.conn.GetState()
+}
+
+/*
+	Idle counts as ready, the next RPC brings the channel back up
+*/
+func (s *ServiceAuth) Ready() bool {
+	state := s.State()
+	return state == connectivity.Ready || state == connectivity.Idle
+}
+
+/*
+	Returns the ServiceAuth client, ErrServiceAuthUnavailable while the link is down
+*/
+func (s *ServiceAuth) Client() (pb.ServiceAuthClient, error) {
+
+	if !s.Ready() {
+		return nil, ErrServiceAuthUnavailable
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.client, nil
+}
+
+func (s *ServiceAuth) BreakerState() string {
+	return s.breaker.State()
+}
+
+func (s *ServiceAuth) BackendStatus() (int, int) {
+	return s.backends.Status()
+}
+
+func (s *ServiceAuth) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	s.client = nil
+
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type CredentialsResponse struct {
+	XMLName     xml.Name      `xml:"Response" json:"-"`
+	Credentials []Credentials `xml:"Credentials" json:"Credentials"`
+}
+
+type Credentials struct {
+	Username       string `xml:"Username" json:"username"`
+	Password       string `xml:"Password" json:"password"`
+	Ttl            int64  `xml:"Ttl" json:"ttl"`
+	Uris           string `xml:"Uris" json:"uris"`
+	ExpiresAt      string `xml:"ExpiresAt" json:"ExpiresAt"`
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	ClientSid      string `xml:"Sid" json:"Sid"`
+}
+
+/*
+	Time-limited credentials in the TURN REST API format :
+	username = expiry unix timestamp:ClientSid
+	password = base64(HMAC-SHA1(shared secret, username))
+	SHA1 keeps them usable by coturn use-auth-secret and other TURN servers
+*/
+func MintCredentials(secret string, uris string, cl Client, ttl int64, now time.Time) Credentials {
+
+	expiry := now.Add(time.Duration(ttl) * time.Second)
+	username := strconv.FormatInt(expiry.Unix(), 10) + ":" + cl.ClientSid
+
+	return Credentials{
+		Username:       username,
+		Password:       TurnPassword(secret, username),
+		Ttl:            ttl,
+		Uris:           uris,
+		ExpiresAt:      expiry.Format(time.ANSIC),
+		AccountSid:     cl.AccountSid,
+		ApplicationSid: cl.ApplicationSid,
+		ClientSid:      cl.ClientSid,
+	}
+}
+
+func TurnPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+	Checks a minted username/password pair, returns the ClientSid it was minted for
+	and when the credentials expire
+*/
+func VerifyTurnCredentials(secret string, username string, password string, now time.Time) (string, time.Time, error) {
+
+	if len(secret) == 0 {
+		return "", time.Time{}, errors.New("Credential minting not configured")
+	}
+
+	parts := strings.SplitN(username, ":", 2)
+
+	if len(parts) != 2 {
+		return "", time.Time{}, errors.New("Malformed credential username")
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil {
+		return "", time.Time{}, errors.New("Malformed credential expiry")
+	}
+
+	if now.Unix() > expiry {
+		return "", time.Time{}, errors.New("Credentials expired")
+	}
+
+	if !hmac.Equal([]byte(TurnPassword(secret, username)), []byte(password)) {
+		return "", time.Time{}, errors.New("Invalid credentials")
+	}
+
+	return parts[1], time.Unix(expiry, 0), nil
+}
+
+/*
+	Mints short-lived credentials for an existing client.
+	Optional Ttl form value (seconds) is capped at the configured maximum
+*/
+func (s *Server) CreateClientCredentials(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("CreateClientCredentials :")
+
+	if len(s.Config.Turn.SharedSecret) == 0 {
+		RenderReponseErr(w, errors.New("TURN_SHARED_SECRET not configured, credential minting disabled"))
+		return
+	}
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	live := s.Live.Load().Turn
+
+	ttl := live.CredentialsTtl
+
+	if v := req.FormValue("Ttl"); len(v) > 0 {
+		var err error
+		ttl, err = strconv.ParseInt(v, 10, 64)
+
+		if err != nil || ttl <= 0 {
+			RenderBadRequestErr(w, errors.New("Invalid Ttl "+v))
+			return
+		}
+	}
+
+	if ttl > live.CredentialsMaxTtl {
+		ttl = live.CredentialsMaxTtl
+	}
+
+	client, respErr := s.Store.Get(req.Context(), params["ClientSid"])
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Create Client Credentials ", respErr)
+		return
+	}
+
+	if client.AccountSid != params["AccountSid"] || client.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	resp := CredentialsResponse{
+		Credentials: []Credentials{MintCredentials(s.Config.Turn.SharedSecret, live.Uris, client, ttl, time.Now())},
+	}
+
+	ext := ReqFormat(params["format"])
+
+	var CredentialsArg interface{}
+
+	if ext == "csv" {
+		CredentialsArg = resp.Credentials
+	} else {
+		CredentialsArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, CredentialsArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
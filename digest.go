@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	DigestMD5    = "MD5"
+	DigestSHA256 = "SHA-256"
+
+	// Outstanding nonces, challenges beyond it are refused until some expire
+	digestMaxNonces = 100000
+)
+
+var (
+	ErrTooManyNonces = errors.New("Too many outstanding digest challenges")
+
+	// Every rejected digest answers the same so responses don't reveal which check failed
+	errDigestInvalid = errors.New("Invalid credentials")
+)
+
+type DigestChallengeResponse struct {
+	XMLName   xml.Name          `xml:"Response" json:"-"`
+	Challenge []DigestChallenge `xml:"Challenge" json:"Challenge"`
+}
+
+type DigestChallenge struct {
+	Realm     string `xml:"Realm" json:"Realm"`
+	Nonce     string `xml:"Nonce" json:"Nonce"`
+	Opaque    string `xml:"Opaque" json:"Opaque"`
+	Algorithm string `xml:"Algorithm" json:"Algorithm"`
+	Qop       string `xml:"Qop" json:"Qop"`
+	ExpiresAt string `xml:"ExpiresAt" json:"ExpiresAt"`
+	Header    string `xml:"Header" json:"Header"`
+}
+
+/*
+	A nonce is only good for the realm, algorithm and qop it was issued with
+*/
+type digestNonce struct {
+	realm     string
+	opaque    string
+	algorithm string
+	qop       string
+	expires   time.Time
+	lastNc    uint64
+}
+
+/*
+	Issued nonces with their expiry and the highest nonce count seen,
+	a response reusing a nonce count is treated as a replay.
+	At most max nonces are outstanding at a time
+*/
+type NonceStore struct {
+	sync.Mutex
+	nonces map[string]*digestNonce
+	max    int
+}
+
+func NewNonceStore(max int) *NonceStore {
+	return &NonceStore{nonces: make(map[string]*digestNonce), max: max}
+}
+
+func (s *NonceStore) Issue(realm string, algorithm string, ttl time.Duration, now time.Time) (string, string, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.nonces) >= s.max {
+		return "", "", time.Time{}, ErrTooManyNonces
+	}
+
+	nonce, opaque := randomHex(16), randomHex(8)
+	expires := now.Add(ttl)
+
+	s.nonces[nonce] = &digestNonce{realm: realm, opaque: opaque, algorithm: algorithm, qop: "auth", expires: expires}
+
+	return nonce, opaque, expires, nil
+}
+
+/*
+	Checks the credentials were answered to a live nonce with the realm,
+	opaque, algorithm and qop it was issued with. Doesn't consume the nonce count
+*/
+func (s *NonceStore) Check(c DigestCredentials, now time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	_, err := s.lookup(c, now)
+
+	return err
+}
+
+/*
+	Accepts the nonce count for a nonce once, counts must strictly increase
+*/
+func (s *NonceStore) Use(c DigestCredentials, nc uint64, now time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	n, err := s.lookup(c, now)
+
+	if err != nil {
+		return err
+	}
+
+	if nc <= n.lastNc {
+		return errors.New("Nonce count replayed")
+	}
+
+	n.lastNc = nc
+
+	return nil
+}
+
+func (s *NonceStore) lookup(c DigestCredentials, now time.Time) (*digestNonce, error) {
+
+	n, ok := s.nonces[c.Nonce]
+
+	if !ok {
+		return nil, errors.New("Unknown nonce")
+	}
+
+	if now.After(n.expires) {
+		delete(s.nonces, c.Nonce)
+		return nil, errors.New("Stale nonce")
+	}
+
+	if n.realm != c.Realm || n.opaque != c.Opaque {
+		return nil, errors.New("Nonce issued for a different realm")
+	}
+
+	// Absent algorithm means MD5, a SHA-256 nonce can't be answered with MD5
+	algorithm := strings.ToUpper(c.Algorithm)
+
+	if len(algorithm) == 0 {
+		algorithm = DigestMD5
+	}
+
+	if n.algorithm != algorithm || n.qop != c.Qop {
+		return nil, errors.New("Nonce issued for algorithm " + n.algorithm + " qop " + n.qop)
+	}
+
+	return n, nil
+}
+
+/*
+	Drops expired nonces, runs for the lifetime of the service
+*/
+func (s *NonceStore) Expire(every time.Duration) {
+
+	for now := range time.Tick(every) {
+		s.Lock()
+		for nonce, n := range s.nonces {
+			if now.After(n.expires) {
+				delete(s.nonces, nonce)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+/*
+	Digest parameters as received in a SIP Authorization header
+*/
+type DigestCredentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	Uri       string
+	Method    string
+	Nc        string
+	Cnonce    string
+	Qop       string
+	Opaque    string
+	Algorithm string
+	Response  string
+}
+
+/*
+	Expected response per RFC 7616 (RFC 2617 for MD5), qop=auth only :
+	HA1 = H(username:realm:password)
+	HA2 = H(method:uri)
+	response = H(HA1:nonce:nc:cnonce:qop:HA2)
+*/
+func DigestResponse(c DigestCredentials, password string) (string, error) {
+
+	var newHash func() hash.Hash
+
+	switch strings.ToUpper(c.Algorithm) {
+	case "", DigestMD5:
+		newHash = md5.New
+	case DigestSHA256:
+		newHash = sha256.New
+	default:
+		return "", errors.New("Unsupported digest algorithm " + c.Algorithm)
+	}
+
+	if c.Qop != "auth" {
+		return "", errors.New("Unsupported qop " + c.Qop)
+	}
+
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := h(c.Username + ":" + c.Realm + ":" + password)
+	ha2 := h(c.Method + ":" + c.Uri)
+
+	return h(ha1 + ":" + c.Nonce + ":" + c.Nc + ":" + c.Cnonce + ":" + c.Qop + ":" + ha2), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+	Issues a digest challenge.
+	Optional form values : Realm, Algorithm (MD5|SHA-256)
+*/
+func (s *Server) CreateDigestChallenge(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("CreateDigestChallenge :")
+
+	params := mux.Vars(req)
+
+	realm := req.FormValue("Realm")
+
+	if len(realm) == 0 {
+		realm = s.Config.Digest.Realm
+	}
+
+	algorithm := strings.ToUpper(req.FormValue("Algorithm"))
+
+	if len(algorithm) == 0 {
+		algorithm = DigestMD5
+	}
+
+	if algorithm != DigestMD5 && algorithm != DigestSHA256 {
+		RenderBadRequestErr(w, errors.New("Unsupported digest algorithm "+algorithm))
+		return
+	}
+
+	nonce, opaque, expires, err := s.Nonces.Issue(realm, algorithm, s.Live.Load().Digest.NonceTtl, time.Now())
+
+	if err != nil {
+		RenderTooManyRequestsErr(w, err)
+		return
+	}
+
+	c := DigestChallenge{
+		Realm:     realm,
+		Nonce:     nonce,
+		Opaque:    opaque,
+		Algorithm: algorithm,
+		Qop:       "auth",
+		ExpiresAt: expires.Format(time.ANSIC),
+	}
+
+	c.Header = `Digest realm="` + c.Realm + `", nonce="` + c.Nonce + `", opaque="` + c.Opaque +
+		`", algorithm=` + c.Algorithm + `, qop="auth"`
+
+	resp := DigestChallengeResponse{Challenge: []DigestChallenge{c}}
+
+	ext := ReqFormat(params["format"])
+
+	var ChallengeArg interface{}
+
+	if ext == "csv" {
+		ChallengeArg = resp.Challenge
+	} else {
+		ChallengeArg = resp
+	}
+
+	err = HandleResponseEncoding(w, ext, ChallengeArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
+
+/*
+	Validates a digest response for a client, username is the ClientSid.
+	Form values : Username, Realm, Nonce, Uri, Method, Nc, Cnonce, Qop, Opaque, Algorithm, Response
+	Answers like VerifyClient, Valid carries the outcome
+*/
+func (s *Server) VerifyDigest(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("VerifyDigest :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	c := DigestCredentials{
+		Username:  req.FormValue("Username"),
+		Realm:     req.FormValue("Realm"),
+		Nonce:     req.FormValue("Nonce"),
+		Uri:       req.FormValue("Uri"),
+		Method:    req.FormValue("Method"),
+		Nc:        req.FormValue("Nc"),
+		Cnonce:    req.FormValue("Cnonce"),
+		Qop:       req.FormValue("Qop"),
+		Opaque:    req.FormValue("Opaque"),
+		Algorithm: req.FormValue("Algorithm"),
+		Response:  strings.ToLower(req.FormValue("Response")),
+	}
+
+	if len(c.Username) == 0 || len(c.Nonce) == 0 || len(c.Response) == 0 || len(c.Method) == 0 {
+		RenderBadRequestErr(w, errors.New("Missing Username, Nonce, Method or Response"))
+		return
+	}
+
+	nc, err := strconv.ParseUint(c.Nc, 16, 64)
+
+	if err != nil {
+		RenderBadRequestErr(w, errors.New("Invalid nonce count "+c.Nc))
+		return
+	}
+
+	result, err := s.verifyDigest(req.Context(), c, nc)
+
+	if err != nil {
+		RenderServiceAuthErr(w, "Verify Digest ", err)
+		return
+	}
+
+	resp := VerifyResponse{Verification: []Verification{result}}
+
+	ext := ReqFormat(params["format"])
+
+	var VerifyArg interface{}
+
+	if ext == "csv" {
+		VerifyArg = resp.Verification
+	} else {
+		VerifyArg = resp
+	}
+
+	err = HandleResponseEncoding(w, ext, VerifyArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
+
+/*
+	Returns an error only when the store can't answer. Only unexpired clients of the
+	authenticated account verify, rejections are logged with their cause and come
+	back with the same Reason
+*/
+func (s *Server) verifyDigest(ctx context.Context, c DigestCredentials, nc uint64) (Verification, error) {
+
+	result := Verification{Method: "digest", ClientSid: c.Username}
+
+	reject := func(cause error) (Verification, error) {
+		LoggerFrom(ctx).Infoln("Digest rejected for ", c.Username, " - ", cause.Error())
+		result.Reason = errDigestInvalid.Error()
+		return result, nil
+	}
+
+	// Nonce first, the store isn't queried for responses to unknown challenges
+	if err := s.Nonces.Check(c, time.Now()); err != nil {
+		return reject(err)
+	}
+
+	client, err := s.Store.Get(ctx, c.Username)
+
+	if err != nil {
+		return result, err
+	}
+
+	if len(client.ClientSid) == 0 {
+		return reject(errors.New("Unknown client"))
+	}
+
+	if client.AccountSid != PrincipalFrom(ctx) {
+		return reject(errors.New("Client of account " + client.AccountSid))
+	}
+
+	if expired, err := expiredClient(client, time.Now()); err != nil || expired {
+		return reject(errors.New("Client expired"))
+	}
+
+	expected, err := DigestResponse(c, client.ClientPassword)
+
+	if err != nil {
+		return reject(err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.Response)) != 1 {
+		return reject(errors.New("Invalid digest response"))
+	}
+
+	// Nonce count is only consumed by a correct response so forged requests can't burn it
+	if err := s.Nonces.Use(c, nc, time.Now()); err != nil {
+		return reject(err)
+	}
+
+	result.Valid = true
+	result.AccountSid = client.AccountSid
+	result.ApplicationSid = client.ApplicationSid
+
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVerifyDigest(t *testing.T) {
+
+	store := NewMemoryClientStore()
+	s := newTestServer(t, store)
+
+	cl := Client{AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid}
+
+	if err := store.Create(context.Background(), &cl, "3600"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	challenge := func(algorithm string) DigestCredentials {
+		nonce, opaque, _, err := s.Nonces.Issue("test", algorithm, time.Minute, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DigestCredentials{
+			Username: testClientSid, Realm: "test", Nonce: nonce, Opaque: opaque,
+			Uri: "sip:test", Method: "REGISTER", Nc: "00000001", Cnonce: "c0ffee",
+			Qop: "auth", Algorithm: algorithm,
+		}
+	}
+
+	answer := func(c DigestCredentials, password string) DigestCredentials {
+		r, err := DigestResponse(c, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Response = r
+		return c
+	}
+
+	verify := func(c DigestCredentials, nc uint64) Verification {
+		v, err := s.verifyDigest(context.WithValue(context.Background(), principalKey, testAccountSid), c, nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	sha := answer(challenge(DigestSHA256), cl.ClientPassword)
+
+	if v := verify(sha, 1); !v.Valid {
+		t.Fatalf("valid response rejected : %v", v.Reason)
+	}
+
+	downgraded := sha
+	downgraded.Algorithm = DigestMD5
+	downgraded.Nc = "00000002"
+
+	for name, c := range map[string]DigestCredentials{
+		"replayed nonce count": sha,
+		"md5 downgrade":        answer(downgraded, cl.ClientPassword),
+		"wrong password":       answer(challenge(DigestMD5), "wrong"),
+		"unknown nonce":        answer(DigestCredentials{Username: testClientSid, Realm: "test", Nonce: "0", Qop: "auth"}, cl.ClientPassword),
+		"missing opaque": func() DigestCredentials {
+			c := challenge(DigestMD5)
+			c.Opaque = ""
+			return answer(c, cl.ClientPassword)
+		}(),
+	} {
+		if v := verify(c, 1); v.Valid || v.Reason != "Invalid credentials" {
+			t.Errorf("%v : valid %v reason %v", name, v.Valid, v.Reason)
+		}
+	}
+}
+
+/*
+	Store returning its clients as already expired
+*/
+type expiredClientStore struct {
+	ClientStore
+}
+
+func (e expiredClientStore) Get(ctx context.Context, csid string) (Client, error) {
+	c, err := e.ClientStore.Get(ctx, csid)
+	if len(c.ClientSid) > 0 {
+		c.ExpiresAt = time.Now().Add(-time.Minute).Format(time.ANSIC)
+	}
+	return c, err
+}
+
+func TestVerifyDigestRejectsExpiredAndForeignClients(t *testing.T) {
+
+	const otherAccountSid = "AC00000000000000000000000000000002"
+
+	memory := NewMemoryClientStore()
+
+	cl := Client{AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid}
+
+	if err := memory.Create(context.Background(), &cl, "3600"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		store     ClientStore
+		principal string
+	}{
+		"expired client":            {expiredClientStore{memory}, testAccountSid},
+		"client of another account": {memory, otherAccountSid},
+	} {
+		s := newTestServer(t, tc.store)
+
+		nonce, opaque, _, err := s.Nonces.Issue("test", DigestMD5, time.Minute, time.Now())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := DigestCredentials{
+			Username: testClientSid, Realm: "test", Nonce: nonce, Opaque: opaque,
+			Uri: "sip:test", Method: "REGISTER", Nc: "00000001", Cnonce: "c0ffee", Qop: "auth",
+		}
+
+		c.Response, _ = DigestResponse(c, cl.ClientPassword)
+
+		v, err := s.verifyDigest(context.WithValue(context.Background(), principalKey, tc.principal), c, 1)
+
+		if err != nil || v.Valid || v.Reason != "Invalid credentials" || len(v.AccountSid) > 0 || len(v.ApplicationSid) > 0 {
+			t.Errorf("%v : %+v %v", name, v, err)
+		}
+	}
+}
+
+func TestNonceStoreCap(t *testing.T) {
+
+	nonces := NewNonceStore(1)
+
+	if _, _, _, err := nonces.Issue("test", DigestMD5, time.Minute, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := nonces.Issue("test", DigestMD5, time.Minute, time.Now()); err != ErrTooManyNonces {
+		t.Fatalf("got %v want %v", err, ErrTooManyNonces)
+	}
+}
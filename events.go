@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventCreated         = "created"
+	EventUpdated         = "updated"
+	EventDeleted         = "deleted"
+	EventPasswordRotated = "password-rotated"
+	EventPresence        = "presence"
+
+	eventHeartbeat = 15 * time.Second
+)
+
+const eventHistorySize = 1000
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+type ClientEvent struct {
+	Id             uint64 `xml:"Id" json:"Id"`
+	Type           string `xml:"Type" json:"Type"`
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	ClientSid      string `xml:"Sid" json:"Sid"`
+	Nickname       string `xml:"Nickname,omitempty" json:"Nickname,omitempty"`
+	PresenceStatus string `xml:"PresenceStatus,omitempty" json:"PresenceStatus,omitempty"`
+	DateCreated    string `xml:"DateCreated" json:"DateCreated"`
+}
+
+/*
+	Subscription filter, empty fields match everything
+*/
+type EventFilter struct {
+	AccountSid     string
+	ApplicationSid string
+	Types          []string
+}
+
+func (f EventFilter) Match(e ClientEvent) bool {
+
+	if len(f.AccountSid) > 0 && f.AccountSid != e.AccountSid {
+		return false
+	}
+
+	if len(f.ApplicationSid) > 0 && f.ApplicationSid != e.ApplicationSid {
+		return false
+	}
+
+	if len(f.Types) == 0 {
+		return true
+	}
+
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+type eventSubscriber struct {
+	filter EventFilter
+	ch     chan ClientEvent
+}
+
+/*
+	In-process fan out of client lifecycle events.
+	Keeps a bounded history so subscribers can resume from a Last-Event-ID
+*/
+type EventBus struct {
+	sync.Mutex
+	lastId      uint64
+	history     []ClientEvent
+	size        int
+	subscribers map[*eventSubscriber]struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewEventBus(size int) *EventBus {
+	return &EventBus{
+		size:        size,
+		subscribers: make(map[*eventSubscriber]struct{}),
+		closing:     make(chan struct{}),
+	}
+}
+
+func (b *EventBus) Publish(e ClientEvent) ClientEvent {
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastId++
+	e.Id = b.lastId
+
+	if len(e.DateCreated) == 0 {
+		e.DateCreated = time.Now().Format(time.ANSIC)
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+
+	for s := range b.subscribers {
+		if !s.filter.Match(e) {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+			// Slow consumers are cut off, they resume with Last-Event-ID
+			log.Warnln("Event subscriber too slow, closing subscription at event ", e.Id)
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+
+	return e
+}
+
+/*
+	Registers a subscriber and returns the events newer than lastId
+	still held in history. Channel is closed on Unsubscribe or overflow
+*/
+func (b *EventBus) Subscribe(filter EventFilter, lastId uint64) ([]ClientEvent, *eventSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+
+	var backlog []ClientEvent
+
+	if lastId > 0 {
+		for _, e := range b.history {
+			if e.Id > lastId && filter.Match(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	s := &eventSubscriber{
+		filter: filter,
+		ch:     make(chan ClientEvent, 64),
+	}
+	b.subscribers[s] = struct{}{}
+
+	return backlog, s
+}
+
+func (b *EventBus) Unsubscribe(s *eventSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+/*
+	Publishes the outcome of a create call, updated when the client already existed
+	and password-rotated when the upsert issued a new ClientPassword
+*/
+func (b *EventBus) PublishClientUpsert(cl Client, previous Client, existed bool) {
+
+	e := ClientEvent{
+		Type:           EventCreated,
+		AccountSid:     cl.AccountSid,
+		ApplicationSid: cl.ApplicationSid,
+		ClientSid:      cl.ClientSid,
+		Nickname:       cl.Nickname,
+	}
+
+	if !existed {
+		b.Publish(e)
+		return
+	}
+
+	e.Type = EventUpdated
+	b.Publish(e)
+
+	if previous.ClientPassword != cl.ClientPassword {
+		e.Type = EventPasswordRotated
+		b.Publish(e)
+	}
+}
+
+/*
+	Ends every SSE and WebSocket stream, called when the server starts draining
+*/
+func (b *EventBus) CloseStreams() {
+	b.closeOnce.Do(func() {
+		log.Infoln("Closing event streams...")
+		close(b.closing)
+	})
+}
+
+/*
+	Event feed for an account or, when routed under an application, a single application.
+	Serves WebSocket on upgrade requests and Server-Sent Events otherwise
+*/
+func (s *Server) ClientEvents(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("ClientEvents :")
+
+	params := mux.Vars(req)
+
+	filter := EventFilter{
+		AccountSid:     params["AccountSid"],
+		ApplicationSid: params["ApplicationSid"],
+	}
+
+	if t := req.Form["Type"]; len(t) > 0 {
+		filter.Types = t
+	}
+
+	s.ServeEvents(w, req, filter)
+}
+
+func (s *Server) ServeEvents(w http.ResponseWriter, req *http.Request, filter EventFilter) {
+
+	lastId, err := lastEventId(req)
+
+	if err != nil {
+		RenderBadRequestErr(w, err)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		s.serveEventsWebSocket(w, req, filter, lastId)
+	} else {
+		s.serveEventsSSE(w, req, filter, lastId)
+	}
+}
+
+func (s *Server) serveEventsSSE(w http.ResponseWriter, req *http.Request, filter EventFilter, lastId uint64) {
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		RenderReponseErr(w, errors.New("Streaming unsupported by response writer"))
+		return
+	}
+
+	backlog, sub := s.Events.Subscribe(filter, lastId)
+	defer s.Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range backlog {
+		writeSSEEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+
+		case e, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			writeSSEEvent(w, e)
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+
+		case <-req.Context().Done():
+			LoggerFrom(req.Context()).Infoln("Event stream closed for ", filter.AccountSid, filter.ApplicationSid)
+			return
+
+		case <-s.Events.closing:
+			return
+		}
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, e ClientEvent) {
+
+	data, err := json.Marshal(e)
+
+	if err != nil {
+		log.Errorln("Error encoding client event ", err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+}
+
+func (s *Server) serveEventsWebSocket(w http.ResponseWriter, req *http.Request, filter EventFilter, lastId uint64) {
+
+	conn, err := wsUpgrader.Upgrade(w, req, nil)
+
+	if err != nil {
+		// Upgrader has already replied to the client
+		LoggerFrom(req.Context()).Errorln("Error upgrading event feed to websocket ", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	backlog, sub := s.Events.Subscribe(filter, lastId)
+	defer s.Events.Unsubscribe(sub)
+
+	// Reader only drains control frames and notices the peer going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, e := range backlog {
+		if err := conn.WriteJSON(e); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+
+		case e, ok := <-sub.ch:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber lagging"))
+				return
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				LoggerFrom(req.Context()).Errorln("Error writing websocket event ", err.Error())
+				return
+			}
+
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventHeartbeat)); err != nil {
+				return
+			}
+
+		case <-closed:
+			LoggerFrom(req.Context()).Infoln("Event websocket closed for ", filter.AccountSid, filter.ApplicationSid)
+			return
+
+		case <-req.Context().Done():
+			return
+
+		case <-s.Events.closing:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			return
+		}
+	}
+}
+
+/*
+	Last-Event-ID header as sent by EventSource on reconnect,
+	LastEventId form value for websocket clients
+*/
+func lastEventId(req *http.Request) (uint64, error) {
+
+	v := req.Header.Get("Last-Event-ID")
+
+	if len(v) == 0 {
+		v = req.FormValue("LastEventId")
+	}
+
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(v, 10, 64)
+
+	if err != nil {
+		return 0, errors.New("Invalid Last-Event-ID " + v)
+	}
+
+	return id, nil
+}
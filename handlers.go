@@ -2,24 +2,27 @@ package main
 
 import (
 	"errors"
-	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	//	rest "github.com/zang-cloud/rest-framework"
 	"net/http"
 	//	"fmt"
 	"context"
 	helpers "github.com/zang-cloud/micro-common/helpers"
 	"net"
-	"strings"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func CreateApplicationClient(w http.ResponseWriter, req *http.Request) {
-	log.Infoln("CreateApplicationClient call :")
+func (s *Server) CreateApplicationClient(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("CreateApplicationClient call :")
 
-	log.Infoln("Checking GRPC Service Auth Connection...")
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
 
-	if EmptyStructCheck(AuthClient) {
-		RenderReponseErr(w, errors.New("Could not establish grpc link with Service Auth Client"))
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
 		return
 	}
 
@@ -39,11 +42,68 @@ func CreateApplicationClient(w http.ResponseWriter, req *http.Request) {
 		RemoteIp:       Ip,
 	}
 
-	respErr := CreateNewAppClient(&reqClient, req.FormValue("ttl"))
+	idemKey := req.Header.Get("Idempotency-Key")
+	replayed := false
 
-	if respErr != nil {
-		RenderServiceAuthErr(w, "AppClient Creation", respErr)
-		return
+	if len(idemKey) > 0 {
+		fingerprint := idempotencyFingerprint(reqClient.ApplicationSid, reqClient.ClientSid, user_name, req.FormValue("ttl"))
+
+		stored, done, err := s.Idempotency.Begin(reqClient.AccountSid, idemKey, fingerprint, s.Live.Load().IdempotencyTtl)
+
+		if err != nil {
+			RenderIdempotencyErr(w, err)
+			return
+		}
+
+		if done {
+			LoggerFrom(req.Context()).Infoln("Replaying client creation for Idempotency-Key ", idemKey)
+			reqClient.ClientPassword = stored.ClientPassword
+			reqClient.Ttl = stored.Ttl
+			reqClient.ExpiresAt = stored.ExpiresAt
+			replayed = true
+		}
+	}
+
+	if !replayed {
+
+		// Existing client decides between created and updated events
+		existing, existErr := s.Store.Get(req.Context(), reqClient.ClientSid)
+
+		// Unknown clients come back empty, without the owner Create could overwrite another application's client
+		if existErr != nil {
+			if len(idemKey) > 0 {
+				s.Idempotency.Release(reqClient.AccountSid, idemKey)
+			}
+			RenderServiceAuthErr(w, "AppClient Creation", existErr)
+			return
+		}
+
+		if len(existing.ClientSid) > 0 && (existing.AccountSid != reqClient.AccountSid || existing.ApplicationSid != reqClient.ApplicationSid) {
+			if len(idemKey) > 0 {
+				s.Idempotency.Release(reqClient.AccountSid, idemKey)
+			}
+			RenderForbiddenErr(w, errors.New("Client "+reqClient.ClientSid+" belongs to another application"))
+			return
+		}
+
+		respErr := s.Store.Create(req.Context(), &reqClient, req.FormValue("ttl"))
+
+		if respErr != nil {
+			if len(idemKey) > 0 {
+				s.Idempotency.Release(reqClient.AccountSid, idemKey)
+			}
+			RenderServiceAuthErr(w, "AppClient Creation", respErr)
+			return
+		}
+
+		if len(idemKey) > 0 {
+			s.Idempotency.Complete(reqClient.AccountSid, idemKey, reqClient)
+		}
+
+		s.verifyCache.Evict(reqClient.ClientSid)
+		s.Presence.Renew(reqClient.ClientSid, reqClient.ExpiresAt)
+
+		s.Events.PublishClientUpsert(reqClient, existing, len(existing.ClientSid) > 0)
 	}
 
 	c := SimpleResponse{
@@ -58,7 +118,9 @@ func CreateApplicationClient(w http.ResponseWriter, req *http.Request) {
 				ApplicationSid: params["ApplicationSid"],
 				ClientSid:      params["ClientSid"],
 				ApiVersion:     params["APIVersion"],
-				RemoteIp:       Ip},
+				RemoteIp:       Ip,
+				Ttl:            reqClient.Ttl,
+				ExpiresAt:      reqClient.ExpiresAt},
 		},
 	}
 
@@ -81,25 +143,30 @@ func CreateApplicationClient(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func GetApplicationClient(w http.ResponseWriter, req *http.Request) {
-	log.Infoln("GetApplicationClient :")
+func (s *Server) GetApplicationClient(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("GetApplicationClient :")
 
-	log.Infoln("Checking GRPC Service Auth Connection...")
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
 
-	if EmptyStructCheck(AuthClient) {
-		RenderReponseErr(w, errors.New("Could not establish grpc link with Service Auth Client"))
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
 		return
 	}
 
 	params := mux.Vars(req)
 
-	client, respErr := GetClientBySID(params["ClientSid"])
+	client, respErr := s.Store.Get(req.Context(), params["ClientSid"])
 
 	if respErr != nil {
 		RenderServiceAuthErr(w, "Get Application Client ", respErr)
 		return
 	}
 
+	if client.AccountSid != params["AccountSid"] || client.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
 	Ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 
 	Ip = net.ParseIP(Ip).String()
@@ -108,7 +175,7 @@ func GetApplicationClient(w http.ResponseWriter, req *http.Request) {
 		Client: []Client{
 
 			{DateUpdated: client.DateUpdated,
-				PresenceStatus: client.PresenceStatus,
+				PresenceStatus: s.Presence.Status(client.ClientSid, client.PresenceStatus),
 				Nickname:       client.Nickname,
 				ClientPassword: client.ClientPassword,
 				Uri:            req.URL.EscapedPath(),
@@ -118,7 +185,9 @@ func GetApplicationClient(w http.ResponseWriter, req *http.Request) {
 				ClientSid:      client.ClientSid,
 				DateCreated:    client.DateCreated,
 				ApiVersion:     params["APIVersion"],
-				RemoteIp:       Ip},
+				RemoteIp:       Ip,
+				Ttl:            client.Ttl,
+				ExpiresAt:      client.ExpiresAt},
 		},
 	}
 
@@ -141,21 +210,26 @@ func GetApplicationClient(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func ListApplicationClients(w http.ResponseWriter, req *http.Request) {
+func (s *Server) ListApplicationClients(w http.ResponseWriter, req *http.Request) {
 
-	log.Infoln("ListApplicationClients :")
+	LoggerFrom(req.Context()).Infoln("ListApplicationClients :")
 
-	log.Infoln("Checking GRPC Service Auth Connection...")
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
 
-	if EmptyStructCheck(AuthClient) {
-		RenderReponseErr(w, errors.New("Could not establish grpc link with Service Auth Client"))
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
 		return
 	}
 
 	params := mux.Vars(req)
 
 	page := helpers.ParsePage(req.FormValue("Page"), 0)
-	pageSize := helpers.ParsePageSize(req.FormValue("PageSize"), 50)
+	pageSize := helpers.ParsePageSize(req.FormValue("PageSize"), s.Config.PageSize)
+
+	if err := validExpiredFilter(req.FormValue("Expired")); err != nil {
+		RenderBadRequestErr(w, err)
+		return
+	}
 
 	Ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 
@@ -170,7 +244,7 @@ func ListApplicationClients(w http.ResponseWriter, req *http.Request) {
 		RemoteIp:       Ip,
 	}
 
-	clientArr, totalCount, respErr := ListAppClients(c, int32(page), int32(pageSize))
+	clientArr, totalCount, respErr := s.listClients(req.Context(), c, req.FormValue("Expired"), int32(page), int32(pageSize))
 
 	if respErr != nil {
 		RenderServiceAuthErr(w, "List Application Client ", respErr)
@@ -206,31 +280,134 @@ func ListApplicationClients(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func DeleteApplicationClient(w http.ResponseWriter, req *http.Request) {
-	log.Infoln("DeleteApplicationClient :")
+/*
+	Lists clients across all applications of an account.
+	Optional ApplicationSid form value narrows the listing to a single application
+*/
+func (s *Server) ListAccountClients(w http.ResponseWriter, req *http.Request) {
+
+	LoggerFrom(req.Context()).Infoln("ListAccountClients :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	appSid := req.FormValue("ApplicationSid")
+
+	if len(appSid) > 0 && !ApplicationSidRegexp.MatchString(appSid) {
+		RenderBadRequestErr(w, errors.New("Invalid ApplicationSid "+appSid))
+		return
+	}
+
+	page := helpers.ParsePage(req.FormValue("Page"), 0)
+	pageSize := helpers.ParsePageSize(req.FormValue("PageSize"), s.Config.PageSize)
+
+	if err := validExpiredFilter(req.FormValue("Expired")); err != nil {
+		RenderBadRequestErr(w, err)
+		return
+	}
+
+	Ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+	Ip = net.ParseIP(Ip).String()
+
+	c := Client{
+		Uri:            req.URL.EscapedPath(),
+		SessionId:      "none",
+		AccountSid:     params["AccountSid"],
+		ApplicationSid: appSid,
+		ApiVersion:     params["APIVersion"],
+		RemoteIp:       Ip,
+	}
+
+	clientArr, totalCount, respErr := s.listClients(req.Context(), c, req.FormValue("Expired"), int32(page), int32(pageSize))
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "List Account Client ", respErr)
+		return
+	}
+
+	p := CreatePagination(req, page, pageSize, totalCount)
+	p.Uri = req.URL.EscapedPath()
+
+	resp := &Response{
+		Clients: Clients{
+			Pagination: p,
+			Clients:    clientArr,
+		},
+	}
+
+	ext := ReqFormat(params["format"])
+
+	var ClientArg interface{}
+
+	if ext == "csv" {
+		ClientArg = resp.Clients.Clients
+	} else {
+		ClientArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, ClientArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+
+}
+
+func (s *Server) DeleteApplicationClient(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("DeleteApplicationClient :")
 
-	log.Infoln("Checking GRPC Service Auth Connection...")
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
 
-	if EmptyStructCheck(AuthClient) {
-		RenderReponseErr(w, errors.New("Could not establish grpc link with Service Auth Client"))
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
 		return
 	}
 
 	params := mux.Vars(req)
 
-	err := DeleteClients(params["ClientSid"])
+	existing, err := s.Store.Get(req.Context(), params["ClientSid"])
 
 	if err != nil {
 		RenderServiceAuthErr(w, "Delete Application Client ", err)
 		return
 	}
 
+	if existing.AccountSid != params["AccountSid"] || existing.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	err = s.Store.Delete(req.Context(), params["ClientSid"])
+
+	if err != nil {
+		RenderServiceAuthErr(w, "Delete Application Client ", err)
+		return
+	}
+
+	s.verifyCache.Evict(params["ClientSid"])
+	s.Presence.Clear(params["ClientSid"])
+
+	s.Events.Publish(ClientEvent{
+		Type:           EventDeleted,
+		AccountSid:     params["AccountSid"],
+		ApplicationSid: params["ApplicationSid"],
+		ClientSid:      params["ClientSid"],
+	})
+
 	Ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 
 	Ip = net.ParseIP(Ip).String()
 
 	var page, pageSize int64
-	page, pageSize = 0, 50
+	page, pageSize = 0, s.Config.PageSize
 
 	c := Client{
 		Uri:            req.URL.EscapedPath(),
@@ -241,13 +418,15 @@ func DeleteApplicationClient(w http.ResponseWriter, req *http.Request) {
 		RemoteIp:       Ip,
 	}
 
-	clientArr, totalCount, respErr := ListAppClients(c, int32(page), int32(pageSize))
+	clientArr, totalCount, respErr := s.Store.List(req.Context(), c, nil, int32(page), int32(pageSize))
 
 	if respErr != nil {
 		RenderServiceAuthErr(w, "List Application Client ", respErr)
 		return
 	}
 
+	s.overlayPresence(clientArr)
+
 	p := CreatePagination(req, page, pageSize, totalCount)
 	p.Uri = req.URL.EscapedPath()
 
@@ -277,8 +456,130 @@ func DeleteApplicationClient(w http.ResponseWriter, req *http.Request) {
 
 }
 
+/*
+	Refreshes the Ttl of a client from the Ttl form value (seconds from now).
+	ServiceAuth treats create on an existing ClientSid as an upsert,
+	which may also issue a new ClientPassword
+*/
+func (s *Server) ExtendApplicationClientTtl(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("ExtendApplicationClientTtl :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	ttl, err := strconv.ParseInt(req.FormValue("Ttl"), 10, 64)
+
+	if err != nil || ttl < 0 {
+		RenderBadRequestErr(w, errors.New("Invalid Ttl "+req.FormValue("Ttl")))
+		return
+	}
+
+	existing, respErr := s.Store.Get(req.Context(), params["ClientSid"])
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Extend Application Client Ttl ", respErr)
+		return
+	}
+
+	if existing.AccountSid != params["AccountSid"] || existing.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	// Carries the existing ClientPassword, stores keep it instead of issuing a new one
+	client := existing
+
+	respErr = s.Store.Create(req.Context(), &client, strconv.FormatInt(ttl, 10))
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Extend Application Client Ttl ", respErr)
+		return
+	}
+
+	s.verifyCache.Evict(client.ClientSid)
+	s.Presence.Renew(client.ClientSid, client.ExpiresAt)
+
+	s.Events.PublishClientUpsert(client, existing, true)
+
+	Ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+	Ip = net.ParseIP(Ip).String()
+
+	client.Uri = req.URL.EscapedPath()
+	client.SessionId = "none"
+	client.ApiVersion = params["APIVersion"]
+	client.RemoteIp = Ip
+
+	cl := SimpleResponse{Client: []Client{client}}
+
+	ext := ReqFormat(params["format"])
+
+	var ClientArg interface{}
+
+	if ext == "csv" {
+		ClientArg = cl.Client
+	} else {
+		ClientArg = cl
+	}
+
+	err = HandleResponseEncoding(w, ext, ClientArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+
+}
+
+/*
+	Expired form value true|false narrows the listing by TTL expiry,
+	any other non empty value is rejected
+*/
+func validExpiredFilter(v string) error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	if _, err := strconv.ParseBool(v); err != nil {
+		return errors.New("Invalid Expired filter " + v)
+	}
+
+	return nil
+}
+
+func (s *Server) listClients(ctx context.Context, c Client, expiredVal string, page int32, pageSize int32) ([]Client, int64, error) {
+
+	var expired *bool
+
+	if len(expiredVal) > 0 {
+		v, _ := strconv.ParseBool(expiredVal)
+		expired = &v
+	}
+
+	clients, total, err := s.Store.List(ctx, c, expired, page, pageSize)
+
+	s.overlayPresence(clients)
+
+	return clients, total, err
+}
+
+/*
+	Presence set through the REST API takes over the one reported by the store
+*/
+func (s *Server) overlayPresence(clients []Client) {
+	for i := range clients {
+		clients[i].PresenceStatus = s.Presence.Status(clients[i].ClientSid, clients[i].PresenceStatus)
+	}
+}
+
 func NoHandleFound(w http.ResponseWriter, req *http.Request) {
-	log.Infof("Handle Not Found For Request - %v", req)
+	LoggerFrom(req.Context()).Infof("Handle Not Found For Request - %v %v", req.Method, req.URL.Path)
 	http.Error(w, "Requested Resource not found...", http.StatusNotFound)
 }
 
@@ -287,28 +588,115 @@ func HealthCehck(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func ReqContextWithAuth(muxRoute http.Handler) http.Handler {
+/*
+	Routes served without credentials, matched exactly
+*/
+var authExempt = map[string]bool{
+	"/Health":                true,
+	"/Health/live":           true,
+	"/Health/ready":          true,
+	"/metrics":               true,
+	"/.well-known/jwks.json": true,
+}
+
+func (s *Server) ReqContextWithAuth(muxRoute http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 
+		start := time.Now()
+
+		id := requestId(req)
+		w.Header().Set("X-Request-Id", id)
+
+		ctx, span := StartRequestSpan(req)
+		span.SetAttributes(attribute.String("request_id", id))
+
+		ctx = context.WithValue(ctx, requestIdKey, id)
+		ctx = context.WithValue(ctx, loggerKey, log.WithField("request_id", id))
+		req = req.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, ctx: ctx}
+		w = rec
+
+		var accSid string
+
+		defer func() {
+			EndRequestSpan(span, rec.status)
+			logAccess(req, rec, accSid, start)
+		}()
+
 		if err := req.ParseForm(); err != nil {
 			RenderFormParsingErr(w, err)
 			return
 		}
 
-		accSid, authToken, _ := req.BasicAuth()
+		user, authToken, _ := req.BasicAuth()
 
-		if !strings.Contains(req.URL.EscapedPath(), "Health") {
-			/*excep := rest.NewRequest(w, req).AuthRequired()
+		if !authExempt[req.URL.Path] {
 
-			if excep != nil {
-				log.Infoln("Authentication failed...")
+			principal, err := s.Authenticator.Authenticate(req)
+
+			if err != nil {
+				LoggerFrom(ctx).Infoln("Authentication failed... ", err.Error())
+				httpFailedAuth(w)
 				return
-			}*/
+			}
+
+			accSid = principal
+
+			// Only an authenticated account is a principal, ServiceAuth trusts it
+			ctx = context.WithValue(ctx, principalKey, principal)
+			ctx = context.WithValue(ctx, loggerKey, LoggerFrom(ctx).WithField("account_sid", principal))
 		}
 
-		ctx := context.WithValue(req.Context(), "param", map[string]string{"Account_sid": accSid, "auth_Token": authToken})
+		ctx = context.WithValue(ctx, "param", map[string]string{"Account_sid": user, "auth_Token": authToken})
+
+		// Service shutdown aborts the ServiceAuth calls of the request too
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stop := context.AfterFunc(ParentContext, cancel)
+		defer stop()
+
 		muxRoute.ServeHTTP(w, req.WithContext(ctx))
 	})
 
 }
+
+/*
+	Rejects requests for an account other than the authenticated one.
+	Runs after routing, the AccountSid comes from the matched path
+*/
+func AuthorizeAccount(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if accSid, ok := mux.Vars(req)["AccountSid"]; ok && accSid != PrincipalFrom(req.Context()) {
+			RenderForbiddenErr(w, errors.New("Not authorized for account "+accSid))
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+type ctxKey int
+
+const (
+	requestIdKey ctxKey = iota
+	principalKey
+	loggerKey
+)
+
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+/*
+	AccountSid the request authenticated as
+*/
+func PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey).(string)
+	return principal
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testAccountSid = "AC00000000000000000000000000000001"
+	testAppSid     = "AP00000000000000000000000000000001"
+	testClientSid  = "GT00000000000000000000000000000001"
+	testToken      = "00000000000000000000000000000001"
+)
+
+var testFormats = []string{"", ".xml", ".json", ".csv"}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	ParentContext = context.Background()
+	os.Exit(m.Run())
+}
+
+/*
+	Every ClientStore the REST API can run on, ServiceAuth through the in-process fake
+*/
+func testStores(t *testing.T) map[string]func() ClientStore {
+	return map[string]func() ClientStore{
+		"memory": func() ClientStore { return NewMemoryClientStore() },
+		"bolt":   func() ClientStore { return openTestBoltStore(t) },
+		"serviceauth": func() ClientStore {
+			cfg := DefaultConfig()
+			cfg.AccountsMock = true
+			auth := NewServiceAuth(cfg)
+			auth.mock = true
+			auth.client = NewFakeServiceAuth()
+			return NewGRPCClientStore(auth)
+		},
+	}
+}
+
+func newTestServer(t *testing.T, store ClientStore) *Server {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.Apply()
+
+	s, err := NewServer(NewLiveConfig(cfg), nil, store, MockAuthenticator{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func doRequest(t *testing.T, h http.Handler, method string, path string, form url.Values, account string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body io.Reader
+
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req := httptest.NewRequest(method, path, body)
+
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if len(account) > 0 {
+		req.SetBasicAuth(account, testToken)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+/*
+	Clients of a response in any of the formats, single client or listing
+*/
+func decodeClients(t *testing.T, format string, body []byte) []Client {
+	t.Helper()
+
+	switch format {
+	case ".json":
+		var list Response
+		if err := json.Unmarshal(body, &list); err == nil && list.Clients.Pagination != nil {
+			return list.Clients.Clients
+		}
+		var single SimpleResponse
+		if err := json.Unmarshal(body, &single); err != nil {
+			t.Fatalf("invalid json %v : %s", err, body)
+		}
+		return single.Client
+
+	case ".csv":
+		rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+		if err != nil {
+			t.Fatalf("invalid csv %v : %s", err, body)
+		}
+		var clients []Client
+		for _, row := range rows[min(1, len(rows)):] {
+			c := Client{}
+			for i, name := range rows[0] {
+				switch name {
+				case "ClientSid":
+					c.ClientSid = row[i]
+				case "AccountSid":
+					c.AccountSid = row[i]
+				case "ApplicationSid":
+					c.ApplicationSid = row[i]
+				case "Nickname":
+					c.Nickname = row[i]
+				case "ClientPassword":
+					c.ClientPassword = row[i]
+				}
+			}
+			clients = append(clients, c)
+		}
+		return clients
+
+	default:
+		var doc struct {
+			Client  []Client `xml:"Client"`
+			Clients struct {
+				Client []Client `xml:"Client"`
+			} `xml:"Clients"`
+		}
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("invalid xml %v : %s", err, body)
+		}
+		return append(doc.Client, doc.Clients.Client...)
+	}
+}
+
+func appPath(csid string, suffix string) string {
+	p := "/v2/Accounts/" + testAccountSid + "/Applications/" + testAppSid + "/Clients"
+	if len(csid) > 0 {
+		p += "/" + csid
+	}
+	return p + suffix
+}
+
+func TestClientRoutes(t *testing.T) {
+
+	for name, newStore := range testStores(t) {
+		for _, format := range testFormats {
+
+			t.Run(name+format, func(t *testing.T) {
+
+				h := newTestServer(t, newStore()).Routes()
+
+				rec := doRequest(t, h, "POST", appPath(testClientSid, format), url.Values{"nickname": {"alice"}, "ttl": {"3600"}}, testAccountSid)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("create : %v %s", rec.Code, rec.Body)
+				}
+
+				created := decodeClients(t, format, rec.Body.Bytes())
+
+				if len(created) != 1 || created[0].ClientSid != testClientSid || len(created[0].ClientPassword) == 0 {
+					t.Fatalf("create returned %+v", created)
+				}
+
+				rec = doRequest(t, h, "GET", appPath(testClientSid, format), nil, testAccountSid)
+
+				if got := decodeClients(t, format, rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 1 || got[0].Nickname != "alice" || got[0].ClientPassword != created[0].ClientPassword {
+					t.Fatalf("get : %v %+v", rec.Code, got)
+				}
+
+				for _, path := range []string{
+					appPath("", format),
+					"/v2/Accounts/" + testAccountSid + "/Clients" + format,
+					"/v2/Accounts/" + testAccountSid + "/Clients" + format + "?ApplicationSid=" + testAppSid,
+				} {
+					rec = doRequest(t, h, "GET", path, nil, testAccountSid)
+
+					if got := decodeClients(t, format, rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 1 || got[0].ClientSid != testClientSid {
+						t.Fatalf("list %v : %v %+v", path, rec.Code, got)
+					}
+				}
+
+				rec = doRequest(t, h, "GET", appPath("", format)+"?Expired=true", nil, testAccountSid)
+
+				if got := decodeClients(t, format, rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 0 {
+					t.Fatalf("expired list : %v %+v", rec.Code, got)
+				}
+
+				rec = doRequest(t, h, "DELETE", appPath(testClientSid, format), nil, testAccountSid)
+
+				if got := decodeClients(t, format, rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 0 {
+					t.Fatalf("delete : %v %+v", rec.Code, got)
+				}
+
+				rec = doRequest(t, h, "GET", appPath("", format), nil, testAccountSid)
+
+				if got := decodeClients(t, format, rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 0 {
+					t.Fatalf("list after delete : %v %+v", rec.Code, got)
+				}
+			})
+		}
+	}
+}
+
+func TestClientRoutesRejectBadInput(t *testing.T) {
+
+	h := newTestServer(t, NewMemoryClientStore()).Routes()
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		account string
+		code    int
+	}{
+		{"no credentials", "GET", appPath("", ".json"), "", http.StatusUnauthorized},
+		{"bad expired filter", "GET", appPath("", ".json") + "?Expired=maybe", testAccountSid, http.StatusBadRequest},
+		{"bad application filter", "GET", "/v2/Accounts/" + testAccountSid + "/Clients.json?ApplicationSid=nope", testAccountSid, http.StatusBadRequest},
+		{"unknown format", "GET", appPath("", ".yaml"), testAccountSid, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := doRequest(t, h, tc.method, tc.path, nil, tc.account); rec.Code != tc.code {
+				t.Fatalf("got %v want %v : %s", rec.Code, tc.code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAuthExemptPaths(t *testing.T) {
+
+	h := newTestServer(t, NewMemoryClientStore()).Routes()
+
+	for path, code := range map[string]int{
+		"/Health":                http.StatusOK,
+		"/Health/live":           http.StatusOK,
+		"/.well-known/jwks.json": http.StatusOK,
+		"/metrics":               http.StatusOK,
+		"/Healthz":               http.StatusUnauthorized,
+		"/v2/Health":             http.StatusUnauthorized,
+		"/.well-known/other":     http.StatusUnauthorized,
+		"/v2/Accounts/" + testAccountSid + "/Applications/Health/Clients.json": http.StatusUnauthorized,
+	} {
+		if rec := doRequest(t, h, "GET", path, nil, ""); rec.Code != code {
+			t.Errorf("%v : got %v want %v", path, rec.Code, code)
+		}
+	}
+}
+
+func TestAccountAuthorization(t *testing.T) {
+
+	const otherAccountSid = "AC00000000000000000000000000000002"
+
+	h := newTestServer(t, NewMemoryClientStore()).Routes()
+
+	if rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"nickname": {"alice"}}, testAccountSid); rec.Code != http.StatusOK {
+		t.Fatalf("create : %v %s", rec.Code, rec.Body)
+	}
+
+	// Another account's credentials on this account's routes
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", appPath("", ".json")},
+		{"GET", appPath(testClientSid, ".json")},
+		{"POST", appPath(testClientSid, ".json")},
+		{"DELETE", appPath(testClientSid, ".json")},
+		{"GET", "/v2/Accounts/" + testAccountSid + "/Clients.json"},
+		{"GET", "/v2/Accounts/" + testAccountSid + "/Events"},
+	} {
+		if rec := doRequest(t, h, tc.method, tc.path, nil, otherAccountSid); rec.Code != http.StatusForbidden {
+			t.Errorf("%v %v : got %v want %v", tc.method, tc.path, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	// The ClientSid through another account's own routes
+	otherPath := "/v2/Accounts/" + otherAccountSid + "/Applications/" + testAppSid + "/Clients/" + testClientSid + ".json"
+
+	for method, code := range map[string]int{
+		"GET":    http.StatusNotFound,
+		"DELETE": http.StatusNotFound,
+		"POST":   http.StatusForbidden,
+	} {
+		if rec := doRequest(t, h, method, otherPath, nil, otherAccountSid); rec.Code != code {
+			t.Errorf("%v %v : got %v want %v", method, otherPath, rec.Code, code)
+		}
+	}
+
+	rec := doRequest(t, h, "GET", appPath(testClientSid, ".json"), nil, testAccountSid)
+
+	if got := decodeClients(t, ".json", rec.Body.Bytes()); rec.Code != http.StatusOK || len(got) != 1 || got[0].Nickname != "alice" {
+		t.Fatalf("client changed by another account : %v %+v", rec.Code, got)
+	}
+}
+
+/*
+	Store whose lookups fail, as ServiceAuth does on a timeout or an open breaker
+*/
+type failingGetStore struct {
+	ClientStore
+	creates int
+}
+
+func (f *failingGetStore) Get(ctx context.Context, csid string) (Client, error) {
+	return Client{}, ErrCircuitOpen
+}
+
+func (f *failingGetStore) Create(ctx context.Context, cl *Client, ttl string) error {
+	f.creates++
+	return f.ClientStore.Create(ctx, cl, ttl)
+}
+
+func TestCreateAbortsWhenLookupFails(t *testing.T) {
+
+	store := &failingGetStore{ClientStore: NewMemoryClientStore()}
+	h := newTestServer(t, store).Routes()
+
+	if rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"nickname": {"alice"}}, testAccountSid); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create : got %v want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	if store.creates != 0 {
+		t.Fatalf("client created without knowing its owner")
+	}
+}
+
+func TestPrincipalOnlyAfterAuthentication(t *testing.T) {
+
+	s := newTestServer(t, NewMemoryClientStore())
+
+	var principal []string
+
+	h := s.ReqContextWithAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := rpcContext(req.Context(), time.Second)
+		defer cancel()
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+		principal = md.Get("x-principal")
+	}))
+
+	for path, want := range map[string][]string{
+		"/Health":         nil,
+		"/metrics":        nil,
+		"/v2/Verify.json": {testAccountSid},
+	} {
+		principal = nil
+		doRequest(t, h, "GET", path, nil, testAccountSid)
+
+		if len(principal) != len(want) || (len(want) > 0 && principal[0] != want[0]) {
+			t.Errorf("%v : x-principal %v want %v", path, principal, want)
+		}
+	}
+}
+
+func TestRequestLogFields(t *testing.T) {
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	h := newTestServer(t, NewMemoryClientStore()).Routes()
+
+	accessLog := func() *log.Entry {
+		for _, e := range hook.AllEntries() {
+			if e.Message == "access" {
+				return e
+			}
+		}
+		t.Fatal("no access log")
+		return nil
+	}
+
+	// Rejected credentials never show up as the account
+	hook.Reset()
+	req := httptest.NewRequest("GET", appPath("", ".json"), nil)
+	req.SetBasicAuth(testAccountSid, "")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if e := accessLog(); e.Data["account_sid"] != "" {
+		t.Errorf("unauthenticated access log account_sid %v", e.Data["account_sid"])
+	}
+
+	// Error responses are logged with the request's fields
+	hook.Reset()
+	doRequest(t, h, "GET", appPath("", ".json")+"?Expired=maybe", nil, testAccountSid)
+
+	if e := accessLog(); e.Data["account_sid"] != testAccountSid {
+		t.Errorf("access log account_sid %v", e.Data["account_sid"])
+	}
+
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "Bad request") {
+			if e.Data["request_id"] == nil || e.Data["account_sid"] != testAccountSid {
+				t.Errorf("bad request log fields %v", e.Data)
+			}
+			return
+		}
+	}
+
+	t.Error("no bad request log")
+}
+
+func TestExtendTtlKeepsPassword(t *testing.T) {
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+
+			h := newTestServer(t, newStore()).Routes()
+
+			rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"nickname": {"alice"}, "ttl": {"60"}}, testAccountSid)
+			created := decodeClients(t, ".json", rec.Body.Bytes())
+
+			if rec.Code != http.StatusOK || len(created) != 1 {
+				t.Fatalf("create : %v %s", rec.Code, rec.Body)
+			}
+
+			rec = doRequest(t, h, "POST", appPath(testClientSid, "/Ttl.json"), url.Values{"Ttl": {"7200"}}, testAccountSid)
+			extended := decodeClients(t, ".json", rec.Body.Bytes())
+
+			if rec.Code != http.StatusOK || len(extended) != 1 || extended[0].Ttl != 7200 {
+				t.Fatalf("extend : %v %s", rec.Code, rec.Body)
+			}
+
+			if extended[0].ClientPassword != created[0].ClientPassword {
+				t.Fatalf("password rotated by a Ttl extension")
+			}
+		})
+	}
+}
+
+func TestServersDoNotShareState(t *testing.T) {
+
+	a := newTestServer(t, NewMemoryClientStore())
+	b := newTestServer(t, NewMemoryClientStore())
+
+	a.Presence.Set(Presence{ClientSid: testClientSid, PresenceStatus: "busy"}, "")
+	a.Webhooks.Set(Webhook{AccountSid: testAccountSid, ApplicationSid: testAppSid, Url: "https://hooks.example.com"})
+	a.Events.Publish(ClientEvent{Type: EventCreated, AccountSid: testAccountSid, ClientSid: testClientSid})
+	a.Live.Load().WebhookMaxAttempts = 1
+
+	if got := b.Presence.Status(testClientSid, "offline"); got != "offline" {
+		t.Errorf("presence of another server : %v", got)
+	}
+
+	if _, ok := b.Webhooks.Get(testAccountSid, testAppSid); ok {
+		t.Error("webhook of another server")
+	}
+
+	if b.Events.lastId > 0 {
+		t.Errorf("%v events of another server", b.Events.lastId)
+	}
+
+	if b.Live.Load().WebhookMaxAttempts == 1 {
+		t.Error("configuration of another server")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	healthCheckTimeout = 3 * time.Second
+	zangProbeInterval  = 30 * time.Second
+)
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+/*
+	Liveness only tells the process is serving HTTP
+*/
+func HealthLive(w http.ResponseWriter, req *http.Request) {
+	renderHealth(w, HealthReport{Status: "ok"}, true)
+}
+
+/*
+	Readiness requires the ServiceAuth link, its grpc.health.v1 status
+	and the Zang auth backend to be reachable.
+	With a local client store only the store and the auth backend count
+*/
+func (s *Server) HealthReady(w http.ResponseWriter, req *http.Request) {
+
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+
+	report := HealthReport{Status: "ready", Checks: make(map[string]HealthCheck)}
+	ready := true
+
+	check := func(name string, err error, detail string) {
+		c := HealthCheck{Status: "ok", Detail: detail}
+		if err != nil {
+			c.Status = "fail"
+			c.Detail = err.Error()
+			ready = false
+		}
+		report.Checks[name] = c
+	}
+
+	if s.Auth == nil {
+		check("client_store", nil, s.Config.ClientStore.Backend)
+	} else {
+		s.checkServiceAuth(ctx, check)
+	}
+
+	if s.Config.AccountsMock {
+		check("zang_auth_backend", nil, "mock authenticator")
+	} else {
+		check("zang_auth_backend", s.zangProbe.Check(ctx), s.zangProbe.url)
+	}
+
+	if !ready {
+		report.Status = "not ready"
+	}
+
+	renderHealth(w, report, ready)
+}
+
+func (s *Server) checkServiceAuth(ctx context.Context, check func(name string, err error, detail string)) {
+
+	state := s.Auth.State()
+
+	if s.Auth.Ready() {
+		check("serviceauth_connection", nil, state.String())
+	} else {
+		check("serviceauth_connection", errors.New("Service Auth connection "+state.String()), "")
+	}
+
+	backends, ejected := s.Auth.BackendStatus()
+	check("serviceauth_backends", nil, strconv.Itoa(backends)+" resolved, "+strconv.Itoa(ejected)+" ejected")
+
+	if breaker := s.Auth.BreakerState(); breaker == BreakerOpen {
+		check("serviceauth_circuit", ErrCircuitOpen, "")
+	} else {
+		check("serviceauth_circuit", nil, breaker)
+	}
+
+	detail, err := s.Auth.HealthCheck(ctx)
+	check("serviceauth_health", err, detail)
+}
+
+func renderHealth(w http.ResponseWriter, report HealthReport, ok bool) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorln("Error encoding health report ", err.Error())
+	}
+}
+
+/*
+	Queries the grpc.health.v1 service of ServiceAuth.
+	A server without the health service is judged by its connection state alone
+*/
+func (s *ServiceAuth) HealthCheck(ctx context.Context) (string, error) {
+
+	if s.mock {
+		return "in-memory mock", nil
+	}
+
+	s.mu.RLock()
+	conn := s.conn
+	s.mu.RUnlock()
+
+	if conn == nil {
+		return "", ErrServiceAuthUnavailable
+	}
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+
+	if status.Code(err) == codes.Unimplemented {
+		return "health service not implemented", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return "", status.Errorf(codes.Unavailable, "Service Auth health %v", resp.Status)
+	}
+
+	return resp.Status.String(), nil
+}
+
+/*
+	Remembers the outcome of a plain GET against an HTTP backend for a while,
+	so frequent readiness probes don't turn into traffic on the backend.
+	Any HTTP answer, including 401, counts as reachable
+*/
+type ReachabilityProbe struct {
+	url   string
+	every time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (p *ReachabilityProbe) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checked) < p.every {
+		return p.err
+	}
+
+	req, err := http.NewRequest("GET", p.url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+
+	if err == nil {
+		res.Body.Close()
+	}
+
+	p.err = err
+	p.checked = time.Now()
+
+	return p.err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t TLSConfig) Enabled() bool {
+	return len(t.CertFile) > 0 && len(t.KeyFile) > 0
+}
+
+/*
+	Server side TLS from the settings, the certificate comes from the
+	reloader so renewed certificates apply without a restart.
+	Cipher suites only restrict TLS 1.2 and below, Go fixes the 1.3 suites
+*/
+func ServerTLSConfig(t TLSConfig, certs *CertReloader) (*tls.Config, error) {
+
+	minVersion, ok := tlsVersions[t.MinVersion]
+
+	if !ok {
+		return nil, errors.New("Unsupported TLS min version " + t.MinVersion)
+	}
+
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if len(t.CipherSuites) > 0 {
+		suites, err := cipherSuitesByName(strings.Split(t.CipherSuites, ","))
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.CipherSuites = suites
+	}
+
+	return config, nil
+}
+
+func cipherSuitesByName(names []string) ([]uint16, error) {
+
+	known := make(map[string]uint16)
+
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		id, ok := known[name]
+
+		if !ok {
+			return nil, errors.New("Unknown or insecure cipher suite " + name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+/*
+	Sets the server up for HTTPS with HTTP/2
+*/
+func (s *Server) configureTLS() error {
+
+	t := s.Config.TLS
+
+	certs, err := NewCertReloader(t.CertFile, t.KeyFile, "")
+
+	if err != nil {
+		return err
+	}
+
+	config, err := ServerTLSConfig(t, certs)
+
+	if err != nil {
+		return err
+	}
+
+	s.http.TLSConfig = config
+
+	// Fails when the configured cipher suites don't include one HTTP/2 requires
+	if err := http2.ConfigureServer(s.http, &http2.Server{}); err != nil {
+		return err
+	}
+
+	go certs.Watch(s.Config.CertReloadInterval)
+
+	log.Infoln("HTTPS enabled, minimum TLS version ", t.MinVersion)
+
+	if len(t.RedirectAddr) > 0 {
+		s.redirect = &http.Server{
+			Addr:    t.RedirectAddr,
+			Handler: redirectToHTTPS(s.Config.Addr),
+		}
+	}
+
+	return nil
+}
+
+/*
+	Permanent redirect to the HTTPS listener on addr, same host and path
+*/
+func redirectToHTTPS(addr string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		host, _, err := net.SplitHostPort(req.Host)
+
+		if err != nil {
+			host = req.Host
+		}
+
+		if _, port, err := net.SplitHostPort(addr); err == nil && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+var (
+	ErrIdempotencyInFlight = errors.New("A request with this Idempotency-Key is still in progress")
+	ErrIdempotencyMismatch = errors.New("Idempotency-Key was already used with different parameters")
+)
+
+type idempotentRequest struct {
+	fingerprint string
+	done        bool
+	client      Client
+}
+
+/*
+	Remembers client creations by Idempotency-Key so a retried POST replays
+	the first outcome instead of creating the client a second time.
+	Keys are scoped to the account, failed attempts release the key.
+	Kept in process memory, a retry that reaches another instance or comes
+	after a restart isn't recognized
+*/
+type IdempotencyStore struct {
+	sync.Mutex
+	requests *cache.Cache
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{requests: cache.New(cache.NoExpiration, 10*time.Minute)}
+}
+
+/*
+	Claims the key for a request for ttl. Returns the stored client and true when the
+	same request already completed
+*/
+func (s *IdempotencyStore) Begin(scope string, key string, fingerprint string, ttl time.Duration) (Client, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	v, found := s.requests.Get(scope + ":" + key)
+
+	if !found {
+		s.requests.Set(scope+":"+key, &idempotentRequest{fingerprint: fingerprint}, ttl)
+		return Client{}, false, nil
+	}
+
+	r := v.(*idempotentRequest)
+
+	if r.fingerprint != fingerprint {
+		return Client{}, false, ErrIdempotencyMismatch
+	}
+
+	if !r.done {
+		return Client{}, false, ErrIdempotencyInFlight
+	}
+
+	return r.client, true, nil
+}
+
+func (s *IdempotencyStore) Complete(scope string, key string, c Client) {
+	s.Lock()
+	defer s.Unlock()
+
+	if v, found := s.requests.Get(scope + ":" + key); found {
+		r := v.(*idempotentRequest)
+		r.done = true
+		r.client = c
+	}
+}
+
+func (s *IdempotencyStore) Release(scope string, key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests.Delete(scope + ":" + key)
+}
+
+func idempotencyFingerprint(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func RenderIdempotencyErr(w http.ResponseWriter, err error) {
+	LoggerFrom(responseContext(w)).Errorln("Idempotency-Key rejected ", err.Error())
+
+	if err == ErrIdempotencyInFlight {
+		http.Error(w, "Conflict "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	http.Error(w, "Unprocessable Entity "+err.Error(), http.StatusUnprocessableEntity)
+}
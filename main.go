@@ -2,75 +2,156 @@ package main
 
 import (
 	"context"
-	log "github.com/Sirupsen/logrus"
-	pb "github.com/zang-cloud/micro-registration-auth/protos"
-	"google.golang.org/grpc"
+	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	grpc_addr = "localhost:8888"
-	httpAddr  = ":8889"
-
 	ParentContext context.Context
 	ContextCancel context.CancelFunc
-	AuthClient    *ServiceAuth
 )
 
-type ServiceAuth struct {
-	*grpc.ClientConn
-	ServiceClient pb.ServiceAuthClient
-}
-
 func init() {
 
 	log.SetOutput(os.Stdout)
 
-	if endpoint := os.Getenv("GRPC_SERVICE_AUTH_ENDPOINT"); len(endpoint) > 0 {
-		grpc_addr = endpoint
-	}
+}
 
-	if port := os.Getenv("ADDR"); len(port) > 0 {
-		httpAddr = port
-	}
+func main() {
+
+	log.Infoln("Starting Rest Authentication for App Client Service...")
+
+	cfg, configFile, err := LoadConfig(os.Args[1:])
 
-	//TO Use Account MOCK setup
-	if AccMock := os.Getenv("ACCOUNTS_MOCK"); len(AccMock) > 0 {
-		os.Setenv("ACCOUNTS_MOCK", AccMock)
+	if err != nil {
+		log.Fatalf("Error loading configuration %v : %v", configFile, err.Error())
 	}
 
-}
+	cfg.Apply()
 
-func main() {
+	live := NewLiveConfig(cfg)
 
-	log.Infoln("Starting Rest Authentication for App Client Service...")
+	log.Infoln("Configuration file ", configFile)
+	for _, line := range cfg.Redacted() {
+		log.Infoln("  ", line)
+	}
 
 	ParentContext, ContextCancel = context.WithCancel(context.Background())
 	defer ContextCancel()
 
+	shutdownTracing, err := InitTracing(ParentContext, cfg.Tracing)
+
+	if err != nil {
+		log.Fatalf("Error configuring tracing %v : %v", cfg.Tracing.Endpoint, err.Error())
+	}
+
+	// Flushes pending spans, runs after the HTTP server has drained
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("Error flushing traces : %v", err.Error())
+		}
+	}()
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	httpErrChan := make(chan error)
+	var authenticator Authenticator = NewZangAuthenticator(cfg.ZangRestURL, live)
+
+	if cfg.AccountsMock {
+		authenticator = MockAuthenticator{}
+	}
+
+	// ServiceAuth is only dialed when it backs the client store
+	var auth *ServiceAuth
+	var store ClientStore
+
+	switch cfg.ClientStore.Backend {
+
+	case ClientStoreBolt:
+		local, err := OpenBoltClientStore(cfg.ClientStore.Path)
+
+		if err != nil {
+			log.Fatalf("Error opening local client store %v : %v", cfg.ClientStore.Path, err.Error())
+		}
+		defer local.Close()
+
+		go local.Expire(1*time.Minute, cfg.ClientStore.Retention)
+
+		store = local
+
+	case ClientStoreMemory:
+		store = NewMemoryClientStore()
+
+	default:
+		auth = NewServiceAuth(cfg)
+
+		if cfg.AccountsMock {
+			auth = NewMockServiceAuth(cfg)
+		}
+
+		if err := auth.Connect(ParentContext); err != nil {
+			log.Fatalf("Error dialing GRPC Service Auth %v : %v", cfg.ServiceAuth.Endpoint, err.Error())
+		}
+		defer auth.Close()
+
+		store = NewGRPCClientStore(auth)
+	}
+
+	server, err := NewServer(live, auth, store, authenticator)
+
+	if err != nil {
+		log.Fatalf("Error configuring HTTP service : %v", err.Error())
+	}
+
+	httpErrChan := make(chan error, 1)
 
 	go func() {
-		httpErrChan <- HttpServe()
+		httpErrChan <- server.HttpServe()
 	}()
 
-	go grpcServiceAuthClient()
+	go server.WebhookDispatcher()
 
-	select {
+	go server.Nonces.Expire(1 * time.Minute)
+	go server.Presence.Expire(1 * time.Minute)
 
-	case err := <-httpErrChan:
-		log.Errorf("Error Starting HTTP service : %v", err.Error())
+	if len(cfg.JWT.KeysDir) > 0 {
+		if err := server.Keys.Load(cfg.JWT.KeysDir, cfg.JWT.ActiveKid); err != nil {
+			log.Errorf("Error loading token signing keys : %v", err.Error())
+		}
 
-	case <-c:
-		log.Infoln("OS Interrupt Signal! Exiting...  ")
-		os.Exit(0)
+		go server.Keys.Watch(cfg.JWT.KeysDir, cfg.JWT.ActiveKid, jwtKeysReload)
+	}
 
-	case <-ParentContext.Done():
-		log.Infoln("Main Context Closed... ")
+	for {
+		select {
+
+		case err := <-httpErrChan:
+			log.Errorf("Error Starting HTTP service : %v", err.Error())
+			return
+
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				log.Infoln("OS Signal ", sig, "! Reloading configuration...  ")
+				if err := live.Reload(os.Args[1:]); err != nil {
+					log.Errorf("Configuration reload rejected, keeping the running configuration : %v", err.Error())
+				}
+				continue
+			}
+
+			log.Infoln("OS Signal ", sig, "! Shutting down...  ")
+			server.Shutdown(cfg.ShutdownTimeout)
+			return
+
+		case <-ParentContext.Done():
+			log.Infoln("Main Context Closed... ")
+			return
+		}
 	}
 
 }
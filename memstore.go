@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+)
+
+/*
+	ClientStore kept in process memory, for tests and throwaway setups.
+	The fake ServiceAuth of ACCOUNTS_MOCK keeps its clients here too
+*/
+type MemoryClientStore struct {
+	mu      sync.RWMutex
+	clients map[string]*pb.Client
+}
+
+func NewMemoryClientStore() *MemoryClientStore {
+	return &MemoryClientStore{clients: make(map[string]*pb.Client)}
+}
+
+func (m *MemoryClientStore) Create(ctx context.Context, cl *Client, ttl string) error {
+
+	r, err := m.put(cl, ttl)
+
+	if err != nil {
+		return err
+	}
+
+	*cl = ClientFromPb(*cl, r)
+
+	return nil
+}
+
+func (m *MemoryClientStore) Get(ctx context.Context, csid string) (Client, error) {
+
+	r, ok := m.record(csid)
+
+	if !ok {
+		return Client{}, nil
+	}
+
+	return ClientFromPb(Client{}, r), nil
+}
+
+func (m *MemoryClientStore) List(ctx context.Context, c Client, expired *bool, page int32, pageSize int32) ([]Client, int64, error) {
+
+	records, total := m.page(c, expired, pageOffset(page, pageSize), int64(pageSize))
+
+	var clients []Client
+
+	for _, r := range records {
+		clients = append(clients, ClientFromPb(c, r))
+	}
+
+	return clients, total, nil
+}
+
+func (m *MemoryClientStore) Delete(ctx context.Context, csid string) error {
+	return m.remove(csid)
+}
+
+func (m *MemoryClientStore) Ready() bool {
+	return true
+}
+
+/*
+	Creates or replaces the record of cl, returns a copy of it
+*/
+func (m *MemoryClientStore) put(cl *Client, ttl string) (*pb.Client, error) {
+
+	if len(cl.ClientSid) == 0 {
+		return nil, errors.New("Missing ClientSid")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := newClientRecord(cl, ttl, m.clients[cl.ClientSid], time.Now())
+	m.clients[cl.ClientSid] = r
+
+	return copyPbClient(r), nil
+}
+
+func (m *MemoryClientStore) record(csid string) (*pb.Client, bool) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, ok := m.clients[csid]
+
+	if !ok {
+		return nil, false
+	}
+
+	return copyPbClient(r), true
+}
+
+/*
+	Copies of the matching records from offset, at most limit of them
+	unless limit is zero, and the total count of matching records
+*/
+func (m *MemoryClientStore) page(c Client, expired *bool, offset int64, limit int64) ([]*pb.Client, int64) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	records := make([]*pb.Client, 0, len(m.clients))
+
+	for _, r := range m.clients {
+		records = append(records, r)
+	}
+
+	matched, total := pageClientRecords(records, c, expired, offset, limit)
+
+	for i, r := range matched {
+		matched[i] = copyPbClient(r)
+	}
+
+	return matched, total
+}
+
+/*
+	Deletes all the clients or, when one of them doesn't exist, none
+*/
+func (m *MemoryClientStore) remove(csids ...string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, csid := range csids {
+		if _, ok := m.clients[csid]; !ok {
+			return errors.New("Client " + csid + " not found")
+		}
+	}
+
+	for _, csid := range csids {
+		delete(m.clients, csid)
+	}
+
+	return nil
+}
+
+/*
+	Deletes clients whose Ttl ran out more than retention ago
+*/
+func (m *MemoryClientStore) Expire(every time.Duration, retention time.Duration) {
+
+	for now := range time.Tick(every) {
+		m.mu.Lock()
+		for csid, r := range m.clients {
+			if ClientExpired(r, now.Add(-retention)) {
+				delete(m.clients, csid)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func copyPbClient(cl *pb.Client) *pb.Client {
+	c := *cl
+	return &c
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godrone_http_requests_total",
+		Help: "HTTP requests by route template, method, format and status code.",
+	}, []string{"route", "method", "format", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "godrone_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template, method and format.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "format"})
+
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "godrone_serviceauth_call_duration_seconds",
+		Help:    "ServiceAuth gRPC call latency by method and status code, one observation per attempt.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	authCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godrone_auth_cache_total",
+		Help: "Zang credential cache lookups by result (hit, miss).",
+	}, []string{"result"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godrone_auth_failures_total",
+		Help: "Rejected API authentications by reason.",
+	}, []string{"reason"})
+
+	breakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "godrone_serviceauth_breaker_state",
+		Help: "ServiceAuth circuit breaker state, 0 closed, 1 half-open, 2 open.",
+	})
+
+	breakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godrone_serviceauth_breaker_transitions_total",
+		Help: "ServiceAuth circuit breaker state changes by previous and new state.",
+	}, []string{"from", "to"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, grpcDuration, authCache, authFailures, breakerState, breakerTransitions)
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+/*
+	Records count and latency of each request under its mux route template,
+	so the Sids in the path don't blow up the label cardinality
+*/
+func InstrumentRoute(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		route := "unknown"
+
+		if r := mux.CurrentRoute(req); r != nil {
+			if tpl, err := r.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		format := strings.TrimPrefix(mux.Vars(req)["format"], ".")
+
+		if len(format) == 0 {
+			format = "xml"
+		}
+
+		trace.SpanFromContext(req.Context()).SetName(req.Method + " " + route)
+
+		ctx, span := tracer.Start(req.Context(), route, trace.WithAttributes(attribute.String("http.route", route)))
+		defer span.End()
+
+		// Reuse the recorder of ReqContextWithAuth so both see the same response
+		rec, ok := w.(*statusRecorder)
+
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		}
+
+		rec.ctx = ctx
+		rec.route = route
+		start := time.Now()
+
+		next.ServeHTTP(rec, req.WithContext(ctx))
+
+		httpDuration.WithLabelValues(route, req.Method, format).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, req.Method, format, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+/*
+	Remembers the status code, size and route of the response, and the context
+	of the handler for spans started from the encoding. Flush and Hijack are
+	passed through for the event stream and presence websocket
+*/
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+	ctx         context.Context
+	route       string
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, errors.New("Connection does not support hijacking")
+	}
+
+	r.status = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+
+	return h.Hijack()
+}
+
+/*
+	Observes every ServiceAuth attempt, retries show up as separate calls
+*/
+func MetricsUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	start := time.Now()
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	grpcDuration.WithLabelValues(method[strings.LastIndexByte(method, '/')+1:], status.Code(err).String()).Observe(time.Since(start).Seconds())
+
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+	"google.golang.org/grpc"
+)
+
+// How long the mock keeps expired clients around before dropping them
+const mockExpiredRetention = 24 * time.Hour
+
+/*
+	In-process stand-in for ServiceAuth used with ACCOUNTS_MOCK, clients live
+	in a MemoryClientStore so the mock and the memory backend behave alike.
+	Embeds the interface so RPCs the REST API never calls stay unimplemented
+*/
+type FakeServiceAuth struct {
+	pb.ServiceAuthClient
+
+	store *MemoryClientStore
+}
+
+func NewFakeServiceAuth() *FakeServiceAuth {
+	return &FakeServiceAuth{store: NewMemoryClientStore()}
+}
+
+func (f *FakeServiceAuth) Create(ctx context.Context, in *pb.ClientOperRequest, opts ...grpc.CallOption) (*pb.ClientOperResponse, error) {
+
+	if in.Client == nil {
+		return &pb.ClientOperResponse{Status: pb.ResponseCode_ERROR, Error: "Missing Client"}, nil
+	}
+
+	cl := Client{
+		AccountSid:     in.Client.AccountSid,
+		ApplicationSid: in.Client.ApplicationSid,
+		ClientSid:      in.Client.ClientSid,
+		Nickname:       in.Client.Nickname,
+		ClientPassword: in.Client.ClientToken,
+	}
+
+	r, err := f.store.put(&cl, strconv.FormatInt(in.Client.Ttl, 10))
+
+	if err != nil {
+		return &pb.ClientOperResponse{Status: pb.ResponseCode_ERROR, Error: err.Error()}, nil
+	}
+
+	return &pb.ClientOperResponse{Status: pb.ResponseCode_OK, Client: r}, nil
+}
+
+func (f *FakeServiceAuth) GetClientByClientSid(ctx context.Context, in *pb.ClientId, opts ...grpc.CallOption) (*pb.ClientsResponse, error) {
+
+	resp := &pb.ClientsResponse{Status: pb.ResponseCode_OK}
+
+	if r, ok := f.store.record(in.ClientSid); ok {
+		resp.Clients = []*pb.Client{r}
+		resp.TotalCount = 1
+	}
+
+	return resp, nil
+}
+
+func (f *FakeServiceAuth) GetClientListByFetchFields(ctx context.Context, in *pb.FetchInputFields, opts ...grpc.CallOption) (*pb.ClientsResponse, error) {
+
+	c := Client{AccountSid: in.AccountSid, ApplicationSid: in.ApplicationSid}
+
+	records, total := f.store.page(c, nil, int64(in.Offset), int64(in.Limit))
+
+	return &pb.ClientsResponse{Status: pb.ResponseCode_OK, Clients: records, TotalCount: total}, nil
+}
+
+func (f *FakeServiceAuth) DeleteClientsWithCheck(ctx context.Context, in *pb.ClientIds, opts ...grpc.CallOption) (*pb.DeleteResponse, error) {
+
+	var csids []string
+
+	for _, id := range in.ClientSids {
+		csids = append(csids, id.ClientSid)
+	}
+
+	if err := f.store.remove(csids...); err != nil {
+		return &pb.DeleteResponse{Status: pb.ResponseCode_ERROR, Err: err.Error()}, nil
+	}
+
+	return &pb.DeleteResponse{Status: pb.ResponseCode_OK}, nil
+}
+
+/*
+	Reaps clients expired for longer than retention, the real service keeps
+	them until deleted so a long retention matches it best
+*/
+func (f *FakeServiceAuth) Expire(every time.Duration, retention time.Duration) {
+	f.store.Expire(every, retention)
+}
+
+/*
+	Decides who a request is authenticated as
+*/
+type Authenticator interface {
+	Authenticate(req *http.Request) (string, error)
+}
+
+/*
+	Checks Basic Auth credentials against the Zang REST API,
+	accepted credentials are cached for a while
+*/
+type ZangAuthenticator struct {
+	url   string
+	cache *cache.Cache
+	live  *LiveConfig
+}
+
+func NewZangAuthenticator(url string, live *LiveConfig) *ZangAuthenticator {
+	return &ZangAuthenticator{url: url, cache: cache.New(cache.NoExpiration, 1*time.Minute), live: live}
+}
+
+func (z *ZangAuthenticator) Authenticate(req *http.Request) (string, error) {
+	accountSid, _, err := httpAuth_check(req, z.url, z.cache, z.live.Load().AuthCacheTtl)
+	return accountSid, err
+}
+
+/*
+	Accepts any well formed AccountSid with a non empty token, for offline demos
+*/
+type MockAuthenticator struct{}
+
+func (MockAuthenticator) Authenticate(req *http.Request) (string, error) {
+
+	accountSid, authToken, ok := req.BasicAuth()
+
+	if !ok || len(authToken) == 0 || !AccountSidRegexp.MatchString(accountSid) {
+		authFailures.WithLabelValues("malformed").Inc()
+		return "", errors.New("Basic Authentication failed")
+	}
+
+	return accountSid, nil
+}
+
+/*
+	Mock ServiceAuth, never dials and is always ready
+*/
+func NewMockServiceAuth(cfg *Config) *ServiceAuth {
+
+	log.Warnln("ACCOUNTS_MOCK set, serving from an in-memory Service Auth")
+
+	fake := NewFakeServiceAuth()
+	go fake.Expire(1*time.Minute, mockExpiredRetention)
+
+	s := NewServiceAuth(cfg)
+	s.mock = true
+	s.client = fake
+
+	return s
+}
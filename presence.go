@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Presence statuses a client can be set to
+var presenceStatuses = map[string]bool{
+	"online":  true,
+	"away":    true,
+	"busy":    true,
+	"offline": true,
+}
+
+type PresenceResponse struct {
+	XMLName  xml.Name   `xml:"Response" json:"-"`
+	Presence []Presence `xml:"Presence" json:"Presence"`
+}
+
+type Presence struct {
+	ClientSid      string `xml:"Sid" json:"Sid"`
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	PresenceStatus string `xml:"PresenceStatus" json:"PresenceStatus"`
+	DateUpdated    string `xml:"DateUpdated" json:"DateUpdated"`
+}
+
+/*
+	Presence overrides set through the REST API, keyed by ClientSid.
+	The store's presence is used whenever no override is held for a client.
+	Overrides live in process memory, each instance only knows the ones set through it
+*/
+type PresenceHub struct {
+	sync.RWMutex
+	status map[string]presenceOverride
+	events *EventBus
+}
+
+func NewPresenceHub(events *EventBus) *PresenceHub {
+	return &PresenceHub{
+		status: make(map[string]presenceOverride),
+		events: events,
+	}
+}
+
+/*
+	Override of a client's presence, dropped once the client expires
+	so clients expired by ServiceAuth don't keep theirs forever
+*/
+type presenceOverride struct {
+	Presence
+	expires time.Time
+}
+
+func (o presenceOverride) expired(now time.Time) bool {
+	return !o.expires.IsZero() && !now.Before(o.expires)
+}
+
+/*
+	Returns the presence override held for the client,
+	falls back to the presence reported by the store
+*/
+func (h *PresenceHub) Status(csid string, fallback string) string {
+	h.RLock()
+	defer h.RUnlock()
+
+	if o, ok := h.status[csid]; ok && !o.expired(time.Now()) {
+		return o.PresenceStatus
+	}
+
+	return fallback
+}
+
+/*
+	Stores the presence of a client until the client's ExpiresAt and
+	publishes it on the event bus for the client's application stream
+*/
+func (h *PresenceHub) Set(p Presence, expiresAt string) {
+	h.Lock()
+	h.status[p.ClientSid] = presenceOverride{Presence: p, expires: presenceExpiry(expiresAt)}
+	h.Unlock()
+
+	h.events.Publish(ClientEvent{
+		Type:           EventPresence,
+		AccountSid:     p.AccountSid,
+		ApplicationSid: p.ApplicationSid,
+		ClientSid:      p.ClientSid,
+		PresenceStatus: p.PresenceStatus,
+	})
+}
+
+/*
+	Moves the expiry of a client's override after its Ttl changed
+*/
+func (h *PresenceHub) Renew(csid string, expiresAt string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if o, ok := h.status[csid]; ok {
+		o.expires = presenceExpiry(expiresAt)
+		h.status[csid] = o
+	}
+}
+
+func (h *PresenceHub) Clear(csid string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.status, csid)
+}
+
+/*
+	Drops the overrides of expired clients
+*/
+func (h *PresenceHub) Expire(every time.Duration) {
+
+	for now := range time.Tick(every) {
+		h.Lock()
+		for csid, o := range h.status {
+			if o.expired(now) {
+				delete(h.status, csid)
+			}
+		}
+		h.Unlock()
+	}
+}
+
+/*
+	ExpiresAt of a client as a time, zero for clients that never expire
+*/
+func presenceExpiry(expiresAt string) time.Time {
+
+	if len(expiresAt) == 0 {
+		return time.Time{}
+	}
+
+	expires, err := time.ParseInLocation(time.ANSIC, expiresAt, time.Local)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return expires
+}
+
+func (s *Server) GetClientPresence(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("GetClientPresence :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	client, respErr := s.Store.Get(req.Context(), params["ClientSid"])
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Get Client Presence ", respErr)
+		return
+	}
+
+	if client.AccountSid != params["AccountSid"] || client.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	resp := PresenceResponse{
+		Presence: []Presence{
+			{
+				ClientSid:      client.ClientSid,
+				AccountSid:     client.AccountSid,
+				ApplicationSid: client.ApplicationSid,
+				PresenceStatus: s.Presence.Status(client.ClientSid, client.PresenceStatus),
+				DateUpdated:    client.DateUpdated,
+			},
+		},
+	}
+
+	renderPresence(w, params["format"], resp)
+}
+
+/*
+	Sets the presence of a client from the PresenceStatus form value,
+	one of online, away, busy or offline, and notifies the application presence stream
+*/
+func (s *Server) SetClientPresence(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("SetClientPresence :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	status := req.FormValue("PresenceStatus")
+
+	if len(status) == 0 {
+		RenderBadRequestErr(w, errors.New("Missing PresenceStatus"))
+		return
+	}
+
+	if !presenceStatuses[status] {
+		RenderBadRequestErr(w, errors.New("Invalid PresenceStatus "+status))
+		return
+	}
+
+	client, respErr := s.Store.Get(req.Context(), params["ClientSid"])
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Set Client Presence ", respErr)
+		return
+	}
+
+	if client.AccountSid != params["AccountSid"] || client.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	p := Presence{
+		ClientSid:      client.ClientSid,
+		AccountSid:     client.AccountSid,
+		ApplicationSid: client.ApplicationSid,
+		PresenceStatus: status,
+		DateUpdated:    time.Now().Format(time.ANSIC),
+	}
+
+	s.Presence.Set(p, client.ExpiresAt)
+
+	renderPresence(w, params["format"], PresenceResponse{Presence: []Presence{p}})
+}
+
+/*
+	Server-Sent Events stream of presence changes for every client of an application
+*/
+func (s *Server) PresenceStream(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("PresenceStream :")
+
+	params := mux.Vars(req)
+
+	s.ServeEvents(w, req, EventFilter{
+		AccountSid:     params["AccountSid"],
+		ApplicationSid: params["ApplicationSid"],
+		Types:          []string{EventPresence},
+	})
+}
+
+func renderPresence(w http.ResponseWriter, format string, resp PresenceResponse) {
+
+	ext := ReqFormat(format)
+
+	var PresenceArg interface{}
+
+	if ext == "csv" {
+		PresenceArg = resp.Presence
+	} else {
+		PresenceArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, PresenceArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func presenceStatus(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	rec := doRequest(t, h, "GET", appPath(testClientSid, "/Presence.json"), nil, testAccountSid)
+
+	var resp PresenceResponse
+
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || len(resp.Presence) != 1 {
+		t.Fatalf("get presence : %v %s", rec.Code, rec.Body)
+	}
+
+	return resp.Presence[0].PresenceStatus
+}
+
+func TestSetClientPresence(t *testing.T) {
+
+	for name, newStore := range testStores(t) {
+
+		t.Run(name, func(t *testing.T) {
+
+			s := newTestServer(t, newStore())
+			h := s.Routes()
+
+			if rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"ttl": {"3600"}}, testAccountSid); rec.Code != http.StatusOK {
+				t.Fatalf("create : %v %s", rec.Code, rec.Body)
+			}
+
+			for _, status := range []string{"", "Online", "invisible"} {
+				if rec := doRequest(t, h, "PUT", appPath(testClientSid, "/Presence.json"), url.Values{"PresenceStatus": {status}}, testAccountSid); rec.Code != http.StatusBadRequest {
+					t.Fatalf("status %q accepted : %v %s", status, rec.Code, rec.Body)
+				}
+			}
+
+			if got := presenceStatus(t, h); got != "offline" {
+				t.Fatalf("presence %q after rejected updates", got)
+			}
+
+			if rec := doRequest(t, h, "PUT", appPath(testClientSid, "/Presence.json"), url.Values{"PresenceStatus": {"busy"}}, testAccountSid); rec.Code != http.StatusOK {
+				t.Fatalf("set presence : %v %s", rec.Code, rec.Body)
+			}
+
+			if got := presenceStatus(t, h); got != "busy" {
+				t.Fatalf("presence %q, want busy", got)
+			}
+
+			if rec := doRequest(t, h, "DELETE", appPath(testClientSid, ".json"), nil, testAccountSid); rec.Code != http.StatusOK {
+				t.Fatalf("delete : %v %s", rec.Code, rec.Body)
+			}
+
+			if got := s.Presence.Status(testClientSid, "offline"); got != "offline" {
+				t.Fatalf("presence %q kept after delete", got)
+			}
+		})
+	}
+}
+
+func TestPresenceExpiresWithClient(t *testing.T) {
+
+	hub := NewPresenceHub(NewEventBus(eventHistorySize))
+
+	expired := time.Now().Add(-time.Minute).Format(time.ANSIC)
+	later := time.Now().Add(time.Hour).Format(time.ANSIC)
+
+	hub.Set(Presence{ClientSid: testClientSid, PresenceStatus: "away"}, expired)
+
+	if got := hub.Status(testClientSid, "offline"); got != "offline" {
+		t.Fatalf("expired override reported : %q", got)
+	}
+
+	hub.Renew(testClientSid, later)
+
+	if got := hub.Status(testClientSid, "offline"); got != "away" {
+		t.Fatalf("renewed override lost : %q", got)
+	}
+
+	hub.Set(Presence{ClientSid: testClientSid, PresenceStatus: "online"}, "")
+
+	if got := hub.Status(testClientSid, "offline"); got != "online" {
+		t.Fatalf("override of a client without Ttl lost : %q", got)
+	}
+}
@@ -7,20 +7,22 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/patrickmn/go-cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"math"
 	"net/http"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 )
 
-var memCache = cache.New(10*time.Minute, 1*time.Minute)
+var AccountSidRegexp = regexp.MustCompile("^AC[0-9a-fA-F]{32}$")
+var ApplicationSidRegexp = regexp.MustCompile("^AP[0-9a-fA-F]{32}$")
 
 const (
-	zangRestURL = "https://api.zang.io"
-	TimeType    = "time.Time"
+	TimeType = "time.Time"
 )
 
 type SimpleResponse struct {
@@ -39,7 +41,7 @@ type Clients struct {
 }
 
 type Client struct {
-	DateUpdated    string `xml:"DateUpdated" json:"DateUpdated`
+	DateUpdated    string `xml:"DateUpdated" json:"DateUpdated"`
 	PresenceStatus string `xml:"PresenceStatus" json:"PresenceStatus"`
 	Nickname       string `xml:"Nickname" json:"Nickname"`
 	ClientPassword string `xml:"ClientPassword" json:"ClientPassword"`
@@ -51,6 +53,8 @@ type Client struct {
 	DateCreated    string `xml:"DateCreated" json:"DateCreated"`
 	ApiVersion     string `xml:"ApiVersion" json:"ApiVersion"`
 	RemoteIp       string `xml:"RemoteIp" json:"RemoteIp"`
+	Ttl            int64  `xml:"Ttl" json:"Ttl"`
+	ExpiresAt      string `xml:"ExpiresAt" json:"ExpiresAt"`
 }
 
 type Pagination struct {
@@ -124,6 +128,20 @@ func CreatePagination(req *http.Request, page int64, pageSize int64, totalCount
 */
 func HandleResponseEncoding(w http.ResponseWriter, format string, resp_obj interface{}) error {
 
+	_, span := tracer.Start(responseContext(w), "encode "+strings.ToLower(format))
+	defer span.End()
+
+	err := encodeResponse(w, format, resp_obj)
+
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+func encodeResponse(w http.ResponseWriter, format string, resp_obj interface{}) error {
+
 	//TODO : Interface{} strict type check to serve it as a common function
 
 	if strings.EqualFold(format, "json") {
@@ -246,7 +264,9 @@ func HandleResponseEncoding(w http.ResponseWriter, format string, resp_obj inter
 	return nil
 }
 
-func httpAuth_check(req *http.Request) (string, string, error) {
+func httpAuth_check(req *http.Request, zangRestURL string, memCache *cache.Cache, cacheTtl time.Duration) (string, string, error) {
+	logger := LoggerFrom(req.Context())
+
 	accountSid, authToken, ok := req.BasicAuth()
 
 	if ok && len(accountSid) == 34 && len(authToken) == 32 {
@@ -254,58 +274,98 @@ func httpAuth_check(req *http.Request) (string, string, error) {
 		cacheKey := fmt.Sprintf("%v:%v", accountSid, authToken)
 
 		if _, found := memCache.Get(cacheKey); found {
-			log.Println("Account Sid found in cache")
+			authCache.WithLabelValues("hit").Inc()
+			logger.Println("Account Sid found in cache")
 			return accountSid, authToken, nil
 		} else {
 
+			authCache.WithLabelValues("miss").Inc()
+
 			// Send request to Zang to check basic auth
-			log.Println("Sending auth request to Zang REST API")
+			logger.Println("Sending auth request to Zang REST API")
 
 			req, err := http.NewRequest("GET", zangRestURL, nil)
 			if err != nil {
-				log.Printf("Error creating auth request to Zang REST API:: %v", err)
+				logger.Printf("Error creating auth request to Zang REST API:: %v", err)
 				return "", "", err
 			}
 
 			req.SetBasicAuth(accountSid, authToken)
-			if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 200 {
-				log.Printf("Error sending auth request to Zang REST API::%v\t%v", err, res.StatusCode)
-				errString := fmt.Errorf("Error sending auth request to Zang REST API::%v\t%v", err, res.StatusCode)
-				return "", "", errString
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				logger.Printf("Error sending auth request to Zang REST API::%v", err)
+				authFailures.WithLabelValues("upstream_error").Inc()
+				return "", "", err
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				logger.Printf("Auth request rejected by Zang REST API::%v", res.StatusCode)
+				authFailures.WithLabelValues("rejected").Inc()
+				return "", "", fmt.Errorf("Auth request rejected by Zang REST API::%v", res.StatusCode)
 			}
 
-			log.Println("Account authorized by Zang API", accountSid)
-			memCache.Set(cacheKey, true, cache.DefaultExpiration)
+			logger.Println("Account authorized by Zang API", accountSid)
+			memCache.Set(cacheKey, true, cacheTtl)
 			return accountSid, authToken, nil
 		}
 	}
 
+	authFailures.WithLabelValues("malformed").Inc()
+
 	return "", "", errors.New("Basic Authentication failed")
 }
 
 func httpFailedAuth(w http.ResponseWriter) {
-	log.Println("Authentication failed")
+	LoggerFrom(responseContext(w)).Println("Authentication failed")
 	w.Header().Set("WWW-Authenticate", `Basic realm="api.zang.io"`)
 	http.Error(w, "Unauthorized Access", http.StatusUnauthorized)
 }
 
 func RenderEncodingErr(w http.ResponseWriter, format string, err error) {
-	log.Errorln("Error while encoding format ", format, " Error -", err.Error())
+	LoggerFrom(responseContext(w)).Errorln("Error while encoding format ", format, " Error -", err.Error())
 	http.Error(w, "Internal Server Error "+err.Error(), http.StatusInternalServerError)
 }
 
 func RenderFormParsingErr(w http.ResponseWriter, err error) {
-	log.Printf("Error parsing the form - %v", err.Error())
+	LoggerFrom(responseContext(w)).Printf("Error parsing the form - %v", err.Error())
 	http.Error(w, "Could not parse request ", http.StatusInternalServerError)
 }
 
 func RenderServiceAuthErr(w http.ResponseWriter, function string, err error) {
-	log.Errorln("Error while doing GRPC Service Auth Operation ", function, " Error -", err.Error())
+	LoggerFrom(responseContext(w)).Errorln("Error while doing GRPC Service Auth Operation ", function, " Error -", err.Error())
+
+	if err == ErrServiceAuthUnavailable || err == ErrCircuitOpen || status.Code(err) == codes.Unavailable {
+		RenderUnavailableErr(w, err)
+		return
+	}
+
 	http.Error(w, "Internal Server Error "+err.Error(), http.StatusInternalServerError)
 }
 
+func RenderUnavailableErr(w http.ResponseWriter, err error) {
+	LoggerFrom(responseContext(w)).Errorln("Service unavailable ", err.Error())
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Service Unavailable "+err.Error(), http.StatusServiceUnavailable)
+}
+
+func RenderTooManyRequestsErr(w http.ResponseWriter, err error) {
+	LoggerFrom(responseContext(w)).Errorln("Too many requests ", err.Error())
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Too Many Requests "+err.Error(), http.StatusTooManyRequests)
+}
+
+func RenderForbiddenErr(w http.ResponseWriter, err error) {
+	LoggerFrom(responseContext(w)).Errorln("Forbidden ", err.Error())
+	http.Error(w, "Forbidden "+err.Error(), http.StatusForbidden)
+}
+
+func RenderBadRequestErr(w http.ResponseWriter, err error) {
+	LoggerFrom(responseContext(w)).Errorln("Bad request ", err.Error())
+	http.Error(w, "Bad Request "+err.Error(), http.StatusBadRequest)
+}
+
 func RenderReponseErr(w http.ResponseWriter, err error) {
-	log.Errorln("Error rendering response ", err.Error())
+	LoggerFrom(responseContext(w)).Errorln("Error rendering response ", err.Error())
 	http.Error(w, "Internal Server Error ", http.StatusInternalServerError)
 }
 
@@ -1,29 +1,169 @@
 package main
 
 import (
+	"context"
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
-func HttpServe() error {
+/*
+	HTTP frontend, handlers reach clients through the injected ClientStore
+	and requests are authenticated by the injected Authenticator.
+	Auth is the ServiceAuth connection behind the store, reported by readiness.
+	Config is the configuration the server started with, Live the one in effect.
+	Keys, Nonces and Idempotency hold the token, digest and Idempotency-Key state,
+	Events, Presence and Webhooks the client events and what follows them
+*/
+type Server struct {
+	Config        *Config
+	Live          *LiveConfig
+	Auth          *ServiceAuth
+	Store         ClientStore
+	Authenticator Authenticator
+	Keys          *SigningKeys
+	Nonces        *NonceStore
+	Idempotency   *IdempotencyStore
+	Events        *EventBus
+	Presence      *PresenceHub
+	Webhooks      *WebhookRegistry
 
-	log.Infoln("Starting HTTP Service on - ", httpAddr)
+	verifyCache *VerifyCache
+
+	http      *http.Server
+	redirect  *http.Server
+	zangProbe *ReachabilityProbe
+}
+
+func NewServer(live *LiveConfig, auth *ServiceAuth, store ClientStore, authenticator Authenticator) (*Server, error) {
+	cfg := live.Load()
+	events := NewEventBus(eventHistorySize)
+
+	s := &Server{
+		Config:        cfg,
+		Live:          live,
+		Auth:          auth,
+		Store:         store,
+		Authenticator: authenticator,
+		Keys:          &SigningKeys{},
+		Nonces:        NewNonceStore(digestMaxNonces),
+		Idempotency:   NewIdempotencyStore(),
+		Events:        events,
+		Presence:      NewPresenceHub(events),
+		Webhooks:      NewWebhookRegistry(),
+		verifyCache:   NewVerifyCache(),
+		zangProbe:     &ReachabilityProbe{url: cfg.ZangRestURL, every: zangProbeInterval},
+	}
+
+	s.http = &http.Server{
+		Addr:    cfg.Addr,
+		Handler: s.Routes(),
+	}
+
+	// Event streams never finish on their own, end them as soon as draining starts
+	s.http.RegisterOnShutdown(s.Events.CloseStreams)
+
+	if cfg.TLS.Enabled() {
+		if err := s.configureTLS(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+/*
+	Returns http.ErrServerClosed once Shutdown is called
+*/
+func (s *Server) HttpServe() error {
+
+	if s.http.TLSConfig == nil {
+		log.Infoln("Starting HTTP Service on - ", s.Config.Addr)
+
+		return s.http.ListenAndServe()
+	}
+
+	if s.redirect != nil {
+		go func() {
+			log.Infoln("Redirecting HTTP to HTTPS on - ", s.Config.TLS.RedirectAddr)
+
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorln("Error serving HTTP redirect ", err.Error())
+			}
+		}()
+	}
+
+	log.Infoln("Starting HTTPS Service on - ", s.Config.Addr)
+
+	// Certificate comes from TLSConfig.GetCertificate
+	return s.http.ListenAndServeTLS("", "")
+}
+
+/*
+	Stops accepting connections and waits for in-flight requests until the deadline,
+	then cancels ParentContext so remaining ServiceAuth calls are aborted
+*/
+func (s *Server) Shutdown(timeout time.Duration) error {
+
+	log.Infoln("Draining HTTP requests, deadline ", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
+
+	err := s.http.Shutdown(ctx)
+
+	if err != nil {
+		log.Errorf("Requests still in flight after %v, aborting : %v", timeout, err.Error())
+	}
+
+	ContextCancel()
+
+	return err
+}
+
+func (s *Server) Routes() http.Handler {
 
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(NoHandleFound)
+	router.Use(InstrumentRoute, AuthorizeAccount)
 
 	router.HandleFunc("/Health", HealthCehck).Methods("GET")
+	router.HandleFunc("/Health/live", HealthLive).Methods("GET")
+	router.HandleFunc("/Health/ready", s.HealthReady).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", s.JWKSHandler).Methods("GET")
+	router.Handle("/metrics", MetricsHandler()).Methods("GET")
 
-	ra := router.PathPrefix("/{APIVersion}/Accounts/{AccountSid:AC[0-9a-fA-F]{32}}/Applications/{ApplicationSid:AP[0-9a-fA-F]{32}}").Subrouter()
-	ra.HandleFunc("/Clients{format:(?:\\.xml|\\.csv|\\.json)?}", ListApplicationClients).Methods("GET")
-	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", GetApplicationClient).Methods("GET")
-	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", DeleteApplicationClient).Methods("DELETE")
-	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", CreateApplicationClient).Methods("POST")
+	router.HandleFunc("/{APIVersion}/Verify{format:(?:\\.xml|\\.csv|\\.json)?}", s.VerifyClient).Methods("POST")
+	router.HandleFunc("/{APIVersion}/Digest/Challenge{format:(?:\\.xml|\\.csv|\\.json)?}", s.CreateDigestChallenge).Methods("POST")
+	router.HandleFunc("/{APIVersion}/Digest/Verify{format:(?:\\.xml|\\.csv|\\.json)?}", s.VerifyDigest).Methods("POST")
+
+	router.HandleFunc("/{APIVersion}/Accounts/{AccountSid:AC[0-9a-fA-F]{32}}/Clients{format:(?:\\.xml|\\.csv|\\.json)?}", s.ListAccountClients).Methods("GET")
+	router.HandleFunc("/{APIVersion}/Accounts/{AccountSid:AC[0-9a-fA-F]{32}}/Events", s.ClientEvents).Methods("GET")
 
-	ServeWithContext := ReqContextWithAuth(router)
+	ra := router.PathPrefix("/{APIVersion}/Accounts/{AccountSid:AC[0-9a-fA-F]{32}}/Applications/{ApplicationSid:AP[0-9a-fA-F]{32}}").Subrouter()
+	ra.HandleFunc("/Clients{format:(?:\\.xml|\\.csv|\\.json)?}", s.ListApplicationClients).Methods("GET")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", s.GetApplicationClient).Methods("GET")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", s.DeleteApplicationClient).Methods("DELETE")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}", s.CreateApplicationClient).Methods("POST")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}/Ttl{format:(?:\\.xml|\\.csv|\\.json)?}", s.ExtendApplicationClientTtl).Methods("POST")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}/Credentials{format:(?:\\.xml|\\.csv|\\.json)?}", s.CreateClientCredentials).Methods("POST")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}/Token{format:(?:\\.xml|\\.csv|\\.json)?}", s.CreateClientToken).Methods("POST")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}/Presence{format:(?:\\.xml|\\.csv|\\.json)?}", s.GetClientPresence).Methods("GET")
+	ra.HandleFunc("/Clients/{ClientSid:GT[0-9a-fA-F]{32}}/Presence{format:(?:\\.xml|\\.csv|\\.json)?}", s.SetClientPresence).Methods("PUT")
+	ra.HandleFunc("/Presence/Stream", s.PresenceStream).Methods("GET")
+	ra.HandleFunc("/Events", s.ClientEvents).Methods("GET")
+	ra.HandleFunc("/Webhook{format:(?:\\.xml|\\.csv|\\.json)?}", s.GetApplicationWebhook).Methods("GET")
+	ra.HandleFunc("/Webhook{format:(?:\\.xml|\\.csv|\\.json)?}", s.SetApplicationWebhook).Methods("POST", "PUT")
+	ra.HandleFunc("/Webhook{format:(?:\\.xml|\\.csv|\\.json)?}", s.DeleteApplicationWebhook).Methods("DELETE")
+	ra.HandleFunc("/Webhook/Deliveries{format:(?:\\.xml|\\.csv|\\.json)?}", s.ListWebhookDeliveries).Methods("GET")
+	ra.HandleFunc("/Webhook/DeadLetters{format:(?:\\.xml|\\.csv|\\.json)?}", s.ListWebhookDeadLetters).Methods("GET")
 
-	return http.ListenAndServe(httpAddr, ServeWithContext)
+	return s.ReqContextWithAuth(router)
 
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+)
+
+const (
+	ClientStoreServiceAuth = "serviceauth"
+	ClientStoreBolt        = "bolt"
+	ClientStoreMemory      = "memory"
+)
+
+/*
+	Where application clients are kept. Handlers only go through this,
+	ServiceAuth over gRPC is the default and local stores stand in for it
+*/
+type ClientStore interface {
+	/*
+		Creates the client or replaces the one with the same ClientSid,
+		fills in the password, dates, Ttl and ExpiresAt.
+		A ClientPassword set on cl is kept, otherwise a new one is issued
+	*/
+	Create(ctx context.Context, cl *Client, ttl string) error
+
+	/*
+		An unknown ClientSid gives an empty Client and no error
+	*/
+	Get(ctx context.Context, csid string) (Client, error)
+
+	/*
+		Clients of c.AccountSid, of c.ApplicationSid unless empty.
+		A non nil expired keeps only clients in that expiry state.
+		Returns the page and the total count of matching clients
+	*/
+	List(ctx context.Context, c Client, expired *bool, page int32, pageSize int32) ([]Client, int64, error)
+
+	Delete(ctx context.Context, csid string) error
+
+	Ready() bool
+}
+
+/*
+	ClientStore backed by ServiceAuth
+*/
+type GRPCClientStore struct {
+	Auth *ServiceAuth
+}
+
+func NewGRPCClientStore(auth *ServiceAuth) *GRPCClientStore {
+	return &GRPCClientStore{Auth: auth}
+}
+
+func (g *GRPCClientStore) Create(ctx context.Context, cl *Client, ttl string) error {
+	return g.Auth.CreateNewAppClient(ctx, cl, ttl)
+}
+
+func (g *GRPCClientStore) Get(ctx context.Context, csid string) (Client, error) {
+	return g.Auth.GetClientBySID(ctx, csid)
+}
+
+func (g *GRPCClientStore) List(ctx context.Context, c Client, expired *bool, page int32, pageSize int32) ([]Client, int64, error) {
+
+	if expired == nil {
+		return g.Auth.ListAppClients(ctx, c, page, pageSize)
+	}
+
+	return g.Auth.ListAppClientsByExpiry(ctx, c, *expired, page, pageSize)
+}
+
+func (g *GRPCClientStore) Delete(ctx context.Context, csid string) error {
+	return g.Auth.DeleteClients(ctx, csid)
+}
+
+func (g *GRPCClientStore) Ready() bool {
+	return g.Auth.Ready()
+}
+
+/*
+	Record of a client as a local store keeps it, same shape as ServiceAuth.
+	Replacing an existing client keeps its creation date, a new token is
+	issued unless cl carries its password
+*/
+func newClientRecord(cl *Client, ttl string, existing *pb.Client, now time.Time) *pb.Client {
+
+	ttlVal, _ := strconv.ParseInt(ttl, 10, 64)
+
+	token := cl.ClientPassword
+
+	if len(token) == 0 {
+		token = randomHex(16)
+	}
+
+	created := now
+
+	if existing != nil && existing.DateCreated != nil {
+		created = *existing.DateCreated
+	}
+
+	return &pb.Client{
+		AccountSid:     cl.AccountSid,
+		ApplicationSid: cl.ApplicationSid,
+		ClientSid:      cl.ClientSid,
+		ClientToken:    token,
+		Nickname:       cl.Nickname,
+		Ttl:            ttlVal,
+		Presence:       "offline",
+		DateCreated:    &created,
+		DateUpdated:    &now,
+	}
+}
+
+/*
+	Filters records the way ServiceAuth does, ordered by ClientSid. Returns the
+	records from offset, at most limit of them unless limit is zero,
+	and the total count of matching records
+*/
+func pageClientRecords(records []*pb.Client, c Client, expired *bool, offset int64, limit int64) ([]*pb.Client, int64) {
+
+	sorted := append([]*pb.Client(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ClientSid < sorted[j].ClientSid })
+
+	p := newClientPager(expired, offset, limit)
+
+	for _, r := range sorted {
+		if r.AccountSid != c.AccountSid {
+			continue
+		}
+		if len(c.ApplicationSid) > 0 && r.ApplicationSid != c.ApplicationSid {
+			continue
+		}
+		p.Add(r)
+	}
+
+	return p.page, p.total
+}
+
+/*
+	Pages through records of a listing fed one at a time, in listing order.
+	Applies the expiry filter and only keeps the records of the requested page,
+	so listings don't hold every record in memory
+*/
+type clientPager struct {
+	expired *bool
+	now     time.Time
+	offset  int64
+	limit   int64
+
+	total int64
+	page  []*pb.Client
+}
+
+func newClientPager(expired *bool, offset int64, limit int64) *clientPager {
+	return &clientPager{expired: expired, now: time.Now(), offset: offset, limit: limit}
+}
+
+func (p *clientPager) Add(r *pb.Client) {
+
+	if p.expired != nil && ClientExpired(r, p.now) != *p.expired {
+		return
+	}
+
+	if p.total >= p.offset && (p.limit == 0 || p.total < p.offset+p.limit) {
+		p.page = append(p.page, r)
+	}
+
+	p.total++
+}
+
+/*
+	Offset of a page, pages before the first one read as the first
+*/
+func pageOffset(page int32, pageSize int32) int64 {
+
+	if page < 1 {
+		return 0
+	}
+
+	return int64(page) * int64(pageSize)
+}
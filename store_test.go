@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+)
+
+func TestClientPager(t *testing.T) {
+
+	updated := time.Now().Add(-time.Hour)
+	expired := true
+
+	p := newClientPager(&expired, 2, 2)
+
+	// Every other record expired an hour ago
+	for i := 0; i < 10; i++ {
+		r := &pb.Client{ClientSid: fmt.Sprintf("GT%032d", i), DateUpdated: &updated}
+		if i%2 == 0 {
+			r.Ttl = 60
+		}
+		p.Add(r)
+	}
+
+	if p.total != 5 {
+		t.Errorf("total %v want 5", p.total)
+	}
+
+	if len(p.page) != 2 || p.page[0].ClientSid != fmt.Sprintf("GT%032d", 4) || p.page[1].ClientSid != fmt.Sprintf("GT%032d", 6) {
+		t.Errorf("page %v", p.page)
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	jwtKeysReload       = 60 * time.Second
+	tokenMaxTtl   int64 = 86400
+	tokenGrants         = "sip,webrtc"
+)
+
+type TokenResponse struct {
+	XMLName xml.Name      `xml:"Response" json:"-"`
+	Token   []AccessToken `xml:"Token" json:"Token"`
+}
+
+type AccessToken struct {
+	Token          string `xml:"Token" json:"Token"`
+	Ttl            int64  `xml:"Ttl" json:"Ttl"`
+	ExpiresAt      string `xml:"ExpiresAt" json:"ExpiresAt"`
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	ClientSid      string `xml:"Sid" json:"Sid"`
+}
+
+type TokenClaims struct {
+	Issuer         string   `json:"iss"`
+	Subject        string   `json:"sub"`
+	IssuedAt       int64    `json:"iat"`
+	NotBefore      int64    `json:"nbf"`
+	Expiry         int64    `json:"exp"`
+	Id             string   `json:"jti"`
+	AccountSid     string   `json:"AccountSid"`
+	ApplicationSid string   `json:"ApplicationSid"`
+	ClientSid      string   `json:"ClientSid"`
+	Nickname       string   `json:"Nickname"`
+	Grants         []string `json:"grants"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type signingKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+/*
+	Private keys loaded from JWT_KEYS_DIR, one PEM file per key, kid = file name.
+	The active key signs new tokens, every loaded key is published in the JWKS
+	so tokens signed before a rotation keep verifying until their file is removed
+*/
+type SigningKeys struct {
+	sync.RWMutex
+	keys   map[string]*signingKey
+	active string
+}
+
+func (k *SigningKeys) Load(dir string, activeKid string) error {
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*signingKey)
+	var kids []string
+
+	for _, f := range files {
+		sk, err := loadSigningKey(f)
+
+		if err != nil {
+			log.Errorln("Error loading signing key ", f, " -", err.Error())
+			continue
+		}
+
+		keys[sk.kid] = sk
+		kids = append(kids, sk.kid)
+	}
+
+	if len(keys) == 0 {
+		return errors.New("No signing keys found in " + dir)
+	}
+
+	// Without an explicit kid the newest key by name signs, so keys named by date rotate in order
+	sort.Strings(kids)
+	active := kids[len(kids)-1]
+
+	if len(activeKid) > 0 {
+		if _, ok := keys[activeKid]; !ok {
+			return errors.New("Active signing key " + activeKid + " not found in " + dir)
+		}
+		active = activeKid
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if k.active != active {
+		log.Infoln("Active token signing key - ", active)
+	}
+
+	k.keys = keys
+	k.active = active
+
+	return nil
+}
+
+/*
+	Reloads the key directory periodically to pick up rotated keys
+*/
+func (k *SigningKeys) Watch(dir string, activeKid string, every time.Duration) {
+
+	for range time.Tick(every) {
+		if err := k.Load(dir, activeKid); err != nil {
+			log.Errorln("Error reloading signing keys ", err.Error())
+		}
+	}
+}
+
+func (k *SigningKeys) Active() (*signingKey, bool) {
+	k.RLock()
+	defer k.RUnlock()
+
+	sk, ok := k.keys[k.active]
+	return sk, ok
+}
+
+func (k *SigningKeys) Get(kid string) (*signingKey, bool) {
+	k.RLock()
+	defer k.RUnlock()
+
+	sk, ok := k.keys[kid]
+	return sk, ok
+}
+
+func (k *SigningKeys) JWKS() JWKS {
+	k.RLock()
+	defer k.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+
+	for _, sk := range k.keys {
+		set.Keys = append(set.Keys, sk.jwk())
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	return set
+}
+
+func loadSigningKey(file string) (*signingKey, error) {
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var key interface{}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid: kid, alg: "RS256", key: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		return &signingKey{kid: kid, alg: "ES256", key: k}, nil
+	}
+
+	return nil, errors.New("unsupported key type")
+}
+
+func (sk *signingKey) jwk() JWK {
+
+	j := JWK{Kid: sk.kid, Use: "sig", Alg: sk.alg}
+
+	switch pub := sk.key.Public().(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = b64(pub.N.Bytes())
+		j.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		j.Kty = "EC"
+		j.Crv = "P-256"
+		j.X = b64(padded(pub.X.Bytes(), 32))
+		j.Y = b64(padded(pub.Y.Bytes(), 32))
+	}
+
+	return j
+}
+
+func (sk *signingKey) sign(input []byte) ([]byte, error) {
+
+	digest := sha256.Sum256(input)
+
+	if sk.alg == "RS256" {
+		return sk.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	// JWS ES256 signatures are the fixed width r || s, not ASN.1
+	r, s, err := ecdsa.Sign(rand.Reader, sk.key.(*ecdsa.PrivateKey), digest[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(padded(r.Bytes(), 32), padded(s.Bytes(), 32)...), nil
+}
+
+/*
+	Signs the claims with the active key, returns the compact serialized JWT
+*/
+func (k *SigningKeys) Sign(claims TokenClaims) (string, error) {
+
+	sk, ok := k.Active()
+
+	if !ok {
+		return "", errors.New("No active token signing key")
+	}
+
+	header, err := json.Marshal(tokenHeader{Alg: sk.alg, Typ: "JWT", Kid: sk.kid})
+
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	input := b64(header) + "." + b64(payload)
+
+	sig, err := sk.sign([]byte(input))
+
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + b64(sig), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func padded(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func tokenId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+	Issues a signed access token for an existing client.
+	Optional form values : Ttl (seconds, capped), Grants (comma separated subset of tokenGrants)
+*/
+func (s *Server) CreateClientToken(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("CreateClientToken :")
+
+	if _, ok := s.Keys.Active(); !ok {
+		RenderReponseErr(w, errors.New("JWT_KEYS_DIR not configured, token signing disabled"))
+		return
+	}
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	ttl := s.Live.Load().JWT.TokenTtl
+
+	if v := req.FormValue("Ttl"); len(v) > 0 {
+		var err error
+		ttl, err = strconv.ParseInt(v, 10, 64)
+
+		if err != nil || ttl <= 0 {
+			RenderBadRequestErr(w, errors.New("Invalid Ttl "+v))
+			return
+		}
+	}
+
+	if ttl > tokenMaxTtl {
+		ttl = tokenMaxTtl
+	}
+
+	grants, err := tokenGrantList(req.FormValue("Grants"))
+
+	if err != nil {
+		RenderBadRequestErr(w, err)
+		return
+	}
+
+	client, respErr := s.Store.Get(req.Context(), params["ClientSid"])
+
+	if respErr != nil {
+		RenderServiceAuthErr(w, "Create Client Token ", respErr)
+		return
+	}
+
+	if client.AccountSid != params["AccountSid"] || client.ApplicationSid != params["ApplicationSid"] {
+		NoHandleFound(w, req)
+		return
+	}
+
+	now := time.Now()
+	expiry := now.Add(time.Duration(ttl) * time.Second)
+
+	claims := TokenClaims{
+		Issuer:         s.Config.JWT.Issuer,
+		Subject:        client.ClientSid,
+		IssuedAt:       now.Unix(),
+		NotBefore:      now.Unix(),
+		Expiry:         expiry.Unix(),
+		Id:             tokenId(),
+		AccountSid:     client.AccountSid,
+		ApplicationSid: client.ApplicationSid,
+		ClientSid:      client.ClientSid,
+		Nickname:       client.Nickname,
+		Grants:         grants,
+	}
+
+	token, err := s.Keys.Sign(claims)
+
+	if err != nil {
+		RenderReponseErr(w, err)
+		return
+	}
+
+	resp := TokenResponse{
+		Token: []AccessToken{
+			{
+				Token:          token,
+				Ttl:            ttl,
+				ExpiresAt:      expiry.Format(time.ANSIC),
+				AccountSid:     client.AccountSid,
+				ApplicationSid: client.ApplicationSid,
+				ClientSid:      client.ClientSid,
+			},
+		},
+	}
+
+	ext := ReqFormat(params["format"])
+
+	var TokenArg interface{}
+
+	if ext == "csv" {
+		TokenArg = resp.Token
+	} else {
+		TokenArg = resp
+	}
+
+	err = HandleResponseEncoding(w, ext, TokenArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
+
+/*
+	Requested grants, all of tokenGrants when none are requested.
+	Grants outside tokenGrants are rejected
+*/
+func tokenGrantList(requested string) ([]string, error) {
+
+	if len(strings.TrimSpace(requested)) == 0 {
+		requested = tokenGrants
+	}
+
+	allowed := map[string]bool{}
+
+	for _, g := range strings.Split(tokenGrants, ",") {
+		allowed[g] = true
+	}
+
+	var grants []string
+	seen := map[string]bool{}
+
+	for _, g := range strings.Split(requested, ",") {
+
+		g = strings.TrimSpace(g)
+
+		if len(g) == 0 || seen[g] {
+			continue
+		}
+
+		if !allowed[g] {
+			return nil, errors.New("Unknown grant " + g)
+		}
+
+		seen[g] = true
+		grants = append(grants, g)
+	}
+
+	return grants, nil
+}
+
+func (s *Server) JWKSHandler(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if err := json.NewEncoder(w).Encode(s.Keys.JWKS()); err != nil {
+		RenderEncodingErr(w, "json", err)
+	}
+}
+
+/*
+	Checks signature, issuer and validity window of a token signed by any loaded key
+*/
+func (k *SigningKeys) Verify(token string, issuer string, now time.Time) (TokenClaims, error) {
+
+	var claims TokenClaims
+
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return claims, errors.New("Malformed token")
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return claims, errors.New("Malformed token header")
+	}
+
+	var header tokenHeader
+
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return claims, errors.New("Malformed token header")
+	}
+
+	sk, ok := k.Get(header.Kid)
+
+	if !ok || sk.alg != header.Alg {
+		return claims, errors.New("Unknown token signing key " + header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return claims, errors.New("Malformed token signature")
+	}
+
+	if !sk.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return claims, errors.New("Invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return claims, errors.New("Malformed token claims")
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("Malformed token claims")
+	}
+
+	if claims.Issuer != issuer {
+		return claims, errors.New("Unexpected token issuer " + claims.Issuer)
+	}
+
+	if now.Unix() >= claims.Expiry {
+		return claims, errors.New("Token expired")
+	}
+
+	if now.Unix() < claims.NotBefore {
+		return claims, errors.New("Token not yet valid")
+	}
+
+	return claims, nil
+}
+
+func (sk *signingKey) verify(input []byte, sig []byte) bool {
+
+	digest := sha256.Sum256(input)
+
+	switch pub := sk.key.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	}
+
+	return false
+}
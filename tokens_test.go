@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+	Signs the server's tokens with a fresh P-256 key
+*/
+func loadTestSigningKey(t *testing.T, s *Server) {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "test.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Keys.Load(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateClientTokenGrants(t *testing.T) {
+
+	store := NewMemoryClientStore()
+	s := newTestServer(t, store)
+
+	loadTestSigningKey(t, s)
+
+	cl := Client{AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid}
+
+	if err := store.Create(context.Background(), &cl, "3600"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.Routes()
+
+	for _, tc := range []struct {
+		grants string
+		code   int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"sip", "webrtc"}},
+		{"webrtc", http.StatusOK, []string{"webrtc"}},
+		{" sip, sip ,", http.StatusOK, []string{"sip"}},
+		{"sip,admin", http.StatusBadRequest, nil},
+	} {
+		rec := doRequest(t, h, "POST", appPath(testClientSid, "/Token.json"), url.Values{"Grants": {tc.grants}}, testAccountSid)
+
+		if rec.Code != tc.code {
+			t.Errorf("grants %q : got %v want %v", tc.grants, rec.Code, tc.code)
+			continue
+		}
+
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		var resp TokenResponse
+
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Token) != 1 {
+			t.Fatalf("invalid token response %v : %s", err, rec.Body)
+		}
+
+		claims, err := s.Keys.Verify(resp.Token[0].Token, s.Config.JWT.Issuer, time.Now())
+
+		if err != nil || !reflect.DeepEqual(claims.Grants, tc.want) {
+			t.Errorf("grants %q : claims %v want %v (%v)", tc.grants, claims.Grants, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var tracer = otel.Tracer("github.com/vaibhavk9/godrone")
+
+/*
+	Installs the W3C trace context propagator and, when an endpoint is
+	configured, a batching OTLP exporter. Without one spans are dropped but
+	incoming traceparent headers are still passed on to ServiceAuth.
+	The returned function flushes pending spans on shutdown
+*/
+func InitTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if len(cfg.Endpoint) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	log.Infoln("Exporting traces to ", cfg.Endpoint)
+
+	return provider.Shutdown, nil
+}
+
+/*
+	Starts the server span of a request, continuing the caller's trace if any
+*/
+func StartRequestSpan(req *http.Request) (context.Context, trace.Span) {
+
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return tracer.Start(ctx, req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+		))
+}
+
+func EndRequestSpan(span trace.Span, code int) {
+
+	span.SetAttributes(attribute.Int("http.status_code", code))
+
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(otelcodes.Error, http.StatusText(code))
+	}
+
+	span.End()
+}
+
+/*
+	Context of the request a response belongs to, for work that only gets the ResponseWriter
+*/
+func responseContext(w http.ResponseWriter) context.Context {
+	if r, ok := w.(*statusRecorder); ok && r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+/*
+	Client span per ServiceAuth attempt, the trace context travels in the
+	traceparent metadata so ServiceAuth spans join the request's trace
+*/
+func TracingUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	ctx, span := tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", method)))
+	defer span.End()
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+
+	err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+
+	code := status.Code(err)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", code.String()))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+
+	return err
+}
+
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+	Fake ServiceAuth whose lookups go through the tracing interceptor,
+	remembering the metadata each call would have sent
+*/
+type tracedServiceAuth struct {
+	*FakeServiceAuth
+	sent []metadata.MD
+}
+
+func (f *tracedServiceAuth) GetClientByClientSid(ctx context.Context, in *pb.ClientId, opts ...grpc.CallOption) (*pb.ClientsResponse, error) {
+
+	var resp *pb.ClientsResponse
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		f.sent = append(f.sent, md)
+
+		var err error
+		resp, err = f.FakeServiceAuth.GetClientByClientSid(ctx, in, opts...)
+		return err
+	}
+
+	err := TracingUnaryInterceptor(ctx, "/protos.ServiceAuth/GetClientByClientSid", in, nil, nil, invoker, opts...)
+
+	return resp, err
+}
+
+func TestTracingSpanChain(t *testing.T) {
+
+	if _, err := InitTracing(context.Background(), TracingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := otel.GetTextMapPropagator().(propagation.TraceContext); !ok {
+		t.Fatalf("propagator %T, want only the W3C trace context", otel.GetTextMapPropagator())
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	cfg := DefaultConfig()
+	cfg.AccountsMock = true
+	auth := NewServiceAuth(cfg)
+	auth.mock = true
+	fake := &tracedServiceAuth{FakeServiceAuth: NewFakeServiceAuth()}
+	auth.client = fake
+
+	h := newTestServer(t, NewGRPCClientStore(auth)).Routes()
+
+	if rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"ttl": {"3600"}}, testAccountSid); rec.Code != http.StatusOK {
+		t.Fatalf("create : %v %s", rec.Code, rec.Body)
+	}
+
+	exporter.Reset()
+	fake.sent = nil
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	req := httptest.NewRequest("GET", appPath(testClientSid, ".json"), nil)
+	req.SetBasicAuth(testAccountSid, testToken)
+	req.Header.Set("traceparent", traceparent)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get : %v %s", rec.Code, rec.Body)
+	}
+
+	var server tracetest.SpanStub
+	spans := map[string]tracetest.SpanStub{}
+
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+		if s.SpanKind == trace.SpanKindServer {
+			server = s
+		}
+	}
+
+	handler, ok := spans[strings.TrimPrefix(server.Name, "GET ")]
+	encoding, ok2 := spans["encode json"]
+	call, ok3 := spans["protos.ServiceAuth/GetClientByClientSid"]
+
+	if !strings.HasSuffix(server.Name, "/Clients/{ClientSid:GT[0-9a-fA-F]{32}}{format:(?:\\.xml|\\.csv|\\.json)?}") || !ok || !ok2 || !ok3 {
+		t.Fatalf("missing spans, got %v", names(exporter.GetSpans()))
+	}
+
+	if server.SpanKind != trace.SpanKindServer || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("server span %v does not continue the caller's trace : parent %v", server.SpanKind, server.Parent.SpanID())
+	}
+
+	for _, link := range []struct {
+		name          string
+		child, parent tracetest.SpanStub
+	}{
+		{"handler", handler, server},
+		{"encoding", encoding, handler},
+		{"serviceauth", call, handler},
+	} {
+		if link.child.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || link.child.Parent.SpanID() != link.parent.SpanContext.SpanID() {
+			t.Fatalf("%v span %v is not a child of %v", link.name, link.child.Name, link.parent.Name)
+		}
+	}
+
+	if call.SpanKind != trace.SpanKindClient {
+		t.Fatalf("serviceauth span kind %v", call.SpanKind)
+	}
+
+	if len(fake.sent) != 1 {
+		t.Fatalf("%v ServiceAuth calls, want 1", len(fake.sent))
+	}
+
+	want := "00-" + call.SpanContext.TraceID().String() + "-" + call.SpanContext.SpanID().String() + "-01"
+
+	if got := fake.sent[0].Get("traceparent"); len(got) != 1 || got[0] != want {
+		t.Fatalf("traceparent %v, want %v", got, want)
+	}
+
+	if got := fake.sent[0].Get("baggage"); len(got) != 0 {
+		t.Fatalf("baggage sent to ServiceAuth : %v", got)
+	}
+}
+
+func names(spans tracetest.SpanStubs) []string {
+	var n []string
+	for _, s := range spans {
+		n = append(n, s.Name)
+	}
+	return n
+}
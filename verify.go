@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	VerifyMethodPassword    = "password"
+	VerifyMethodToken       = "token"
+	VerifyMethodCredentials = "credentials"
+)
+
+type VerifyResponse struct {
+	XMLName      xml.Name       `xml:"Response" json:"-"`
+	Verification []Verification `xml:"Verification" json:"Verification"`
+}
+
+type Verification struct {
+	Valid          bool   `xml:"Valid" json:"Valid"`
+	Method         string `xml:"Method" json:"Method"`
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	ClientSid      string `xml:"Sid" json:"Sid"`
+	Reason         string `xml:"Reason" json:"Reason"`
+}
+
+/*
+	Verifies client credentials for SIP/WebRTC edge components.
+	Form values, one of :
+	ClientSid + Password    static ClientPassword
+	Token                   token issued by CreateClientToken
+	Username + Password     credentials minted by CreateClientCredentials
+	Always answers 200, Valid carries the outcome
+*/
+func (s *Server) VerifyClient(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("VerifyClient :")
+
+	LoggerFrom(req.Context()).Infoln("Checking GRPC Service Auth Connection...")
+
+	if !s.Store.Ready() {
+		RenderUnavailableErr(w, ErrServiceAuthUnavailable)
+		return
+	}
+
+	params := mux.Vars(req)
+
+	var method, secret string
+
+	switch {
+	case len(req.FormValue("Token")) > 0:
+		method, secret = VerifyMethodToken, req.FormValue("Token")
+	case len(req.FormValue("Username")) > 0:
+		method, secret = VerifyMethodCredentials, req.FormValue("Username")+":"+req.FormValue("Password")
+	case len(req.FormValue("ClientSid")) > 0:
+		method, secret = VerifyMethodPassword, req.FormValue("ClientSid")+":"+req.FormValue("Password")
+	default:
+		RenderBadRequestErr(w, errors.New("Missing ClientSid, Token or Username"))
+		return
+	}
+
+	// Results depend on the account asking
+	cacheKey := verifyCacheKey(method, PrincipalFrom(req.Context())+":"+secret)
+
+	v, found := s.verifyCache.Get(cacheKey)
+
+	if !found {
+		result, expires, err := s.verify(method, req)
+
+		if err != nil {
+			RenderServiceAuthErr(w, "Verify Client ", err)
+			return
+		}
+
+		// A result never outlives the client, token or credentials it was given for
+		ttl := s.Live.Load().VerifyCacheTtl
+
+		if !expires.IsZero() && time.Until(expires) < ttl {
+			ttl = time.Until(expires)
+		}
+
+		if ttl > 0 {
+			s.verifyCache.Set(cacheKey, result, ttl)
+		}
+
+		v = result
+	}
+
+	resp := VerifyResponse{Verification: []Verification{v}}
+
+	ext := ReqFormat(params["format"])
+
+	var VerifyArg interface{}
+
+	if ext == "csv" {
+		VerifyArg = resp.Verification
+	} else {
+		VerifyArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, VerifyArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
+
+/*
+	Returns an error only when ServiceAuth can't answer,
+	rejected credentials come back as Valid false with a Reason.
+	Only clients of the authenticated account verify.
+	A valid result also returns when the client, token or credentials expire,
+	zero when they don't
+*/
+func (s *Server) verify(method string, req *http.Request) (Verification, time.Time, error) {
+
+	result := Verification{Method: method}
+	now := time.Now()
+
+	var csid, password string
+	var expires time.Time
+	var claims *TokenClaims
+
+	switch method {
+
+	case VerifyMethodToken:
+		c, err := s.Keys.Verify(req.FormValue("Token"), s.Config.JWT.Issuer, now)
+		if err != nil {
+			result.Reason = err.Error()
+			return result, expires, nil
+		}
+		claims = &c
+		csid = c.ClientSid
+		expires = time.Unix(c.Expiry, 0)
+
+	case VerifyMethodCredentials:
+		sid, credExpiry, err := VerifyTurnCredentials(s.Config.Turn.SharedSecret, req.FormValue("Username"), req.FormValue("Password"), now)
+		if err != nil {
+			result.Reason = err.Error()
+			return result, expires, nil
+		}
+		csid = sid
+		expires = credExpiry
+
+	default:
+		csid, password = req.FormValue("ClientSid"), req.FormValue("Password")
+
+		if len(password) == 0 {
+			result.ClientSid = csid
+			result.Reason = "Missing password"
+			return result, expires, nil
+		}
+	}
+
+	result.ClientSid = csid
+
+	// Signed tokens and minted credentials still require the client to exist
+	client, err := s.Store.Get(req.Context(), csid)
+
+	if err != nil {
+		return result, expires, err
+	}
+
+	// Clients of other accounts answer like unknown ones, nothing of them is disclosed
+	if len(client.ClientSid) == 0 || client.AccountSid != PrincipalFrom(req.Context()) {
+		result.Reason = "Unknown client"
+		return result, expires, nil
+	}
+
+	if claims != nil && (claims.AccountSid != client.AccountSid || claims.ApplicationSid != client.ApplicationSid) {
+		result.Reason = "Token does not match the client"
+		return result, expires, nil
+	}
+
+	if expired, err := expiredClient(client, now); err != nil || expired {
+		result.Reason = "Client expired"
+		return result, expires, nil
+	}
+
+	if len(client.ExpiresAt) > 0 {
+		clientExpiry, _ := time.ParseInLocation(time.ANSIC, client.ExpiresAt, time.Local)
+
+		if expires.IsZero() || clientExpiry.Before(expires) {
+			expires = clientExpiry
+		}
+	}
+
+	if method == VerifyMethodPassword && subtle.ConstantTimeCompare([]byte(client.ClientPassword), []byte(password)) != 1 {
+		result.Reason = "Invalid password"
+		return result, expires, nil
+	}
+
+	result.Valid = true
+	result.AccountSid = client.AccountSid
+	result.ApplicationSid = client.ApplicationSid
+
+	return result, expires, nil
+}
+
+/*
+	Clients without a Ttl never expire, an unreadable ExpiresAt is an error
+*/
+func expiredClient(client Client, now time.Time) (bool, error) {
+
+	if len(client.ExpiresAt) == 0 {
+		return false, nil
+	}
+
+	expiry, err := time.ParseInLocation(time.ANSIC, client.ExpiresAt, time.Local)
+
+	if err != nil {
+		return false, err
+	}
+
+	return !now.Before(expiry), nil
+}
+
+/*
+	Verification results keyed by a hash of the presented secret, never the secret itself.
+	Results are indexed by ClientSid too, so a change to a client evicts them at once
+*/
+type VerifyCache struct {
+	mu       sync.Mutex
+	results  *cache.Cache
+	byClient map[string]map[string]bool
+}
+
+func NewVerifyCache() *VerifyCache {
+
+	c := &VerifyCache{
+		results:  cache.New(cache.NoExpiration, 1*time.Minute),
+		byClient: make(map[string]map[string]bool),
+	}
+
+	c.results.OnEvicted(func(key string, v interface{}) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.unindex(v.(Verification).ClientSid, key)
+	})
+
+	return c
+}
+
+func (c *VerifyCache) Get(key string) (Verification, bool) {
+
+	v, found := c.results.Get(key)
+
+	if !found {
+		return Verification{}, false
+	}
+
+	return v.(Verification), true
+}
+
+func (c *VerifyCache) Set(key string, v Verification, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byClient[v.ClientSid] == nil {
+		c.byClient[v.ClientSid] = make(map[string]bool)
+	}
+
+	c.byClient[v.ClientSid][key] = true
+	c.results.Set(key, v, ttl)
+}
+
+/*
+	Drops every cached result of the client
+*/
+func (c *VerifyCache) Evict(csid string) {
+
+	c.mu.Lock()
+	keys := c.byClient[csid]
+	delete(c.byClient, csid)
+	c.mu.Unlock()
+
+	// OnEvicted takes the lock again
+	for key := range keys {
+		c.results.Delete(key)
+	}
+}
+
+func (c *VerifyCache) unindex(csid string, key string) {
+
+	if keys, ok := c.byClient[csid]; ok {
+		delete(keys, key)
+
+		if len(keys) == 0 {
+			delete(c.byClient, csid)
+		}
+	}
+}
+
+func verifyCacheKey(method string, secret string) string {
+	sum := sha256.Sum256([]byte(method + ":" + secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/zang-cloud/micro-registration-auth/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	ServiceAuth answering NotFound for every ClientSid
+*/
+type notFoundServiceAuth struct {
+	pb.ServiceAuthClient
+}
+
+func (notFoundServiceAuth) GetClientByClientSid(ctx context.Context, in *pb.ClientId, opts ...grpc.CallOption) (*pb.ClientsResponse, error) {
+	return nil, status.Error(codes.NotFound, "client "+in.ClientSid+" not found")
+}
+
+func verifyRequest(t *testing.T, h http.Handler, form url.Values) Verification {
+	t.Helper()
+
+	rec := doRequest(t, h, "POST", "/v2/Verify.json", form, testAccountSid)
+
+	var resp VerifyResponse
+
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || len(resp.Verification) != 1 {
+		t.Fatalf("verify %v : %v %s", form, rec.Code, rec.Body)
+	}
+
+	return resp.Verification[0]
+}
+
+func TestVerifyClient(t *testing.T) {
+
+	h := newTestServer(t, NewMemoryClientStore()).Routes()
+
+	create := func() string {
+		rec := doRequest(t, h, "POST", appPath(testClientSid, ".json"), url.Values{"ttl": {"3600"}}, testAccountSid)
+		created := decodeClients(t, ".json", rec.Body.Bytes())
+		if rec.Code != http.StatusOK || len(created) != 1 {
+			t.Fatalf("create : %v %s", rec.Code, rec.Body)
+		}
+		return created[0].ClientPassword
+	}
+
+	password := create()
+
+	if v := verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {password}}); !v.Valid {
+		t.Fatalf("valid password rejected : %v", v.Reason)
+	}
+
+	if v := verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {""}}); v.Valid || v.Reason != "Missing password" {
+		t.Fatalf("empty password : %+v", v)
+	}
+
+	// Re-creating the client issues a new password, the cached result must go with the old one
+	create()
+
+	if v := verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {password}}); v.Valid {
+		t.Fatal("replaced password still valid from the cache")
+	}
+
+	password = create()
+	verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {password}})
+
+	doRequest(t, h, "DELETE", appPath(testClientSid, ".json"), nil, testAccountSid)
+
+	if v := verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {password}}); v.Valid || v.Reason != "Unknown client" {
+		t.Fatalf("deleted client : %+v", v)
+	}
+}
+
+func TestVerifyClientCacheTtlCappedByExpiry(t *testing.T) {
+
+	store := NewMemoryClientStore()
+	s := newTestServer(t, store)
+
+	cl := Client{AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid}
+
+	if err := store.Create(context.Background(), &cl, "60"); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"ClientSid": {testClientSid}, "Password": {cl.ClientPassword}}
+	req := httptest.NewRequest("POST", "/v2/Verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), principalKey, testAccountSid))
+
+	v, expires, err := s.verify(VerifyMethodPassword, req)
+
+	if err != nil || !v.Valid {
+		t.Fatalf("verify : %+v %v", v, err)
+	}
+
+	if d := time.Until(expires); d <= 0 || d > 61*time.Second {
+		t.Fatalf("result expires in %v, want the client's 60s", d)
+	}
+}
+
+func TestVerifyClientNotFoundInServiceAuth(t *testing.T) {
+
+	cfg := DefaultConfig()
+	auth := NewServiceAuth(cfg)
+	auth.mock = true
+	auth.client = notFoundServiceAuth{}
+
+	h := newTestServer(t, NewGRPCClientStore(auth)).Routes()
+
+	if v := verifyRequest(t, h, url.Values{"ClientSid": {testClientSid}, "Password": {"secret"}}); v.Valid || v.Reason != "Unknown client" {
+		t.Fatalf("unknown client : %+v", v)
+	}
+}
+
+func TestVerifyClientOfAnotherAccount(t *testing.T) {
+
+	const otherAccountSid = "AC00000000000000000000000000000002"
+
+	store := NewMemoryClientStore()
+	s := newTestServer(t, store)
+
+	loadTestSigningKey(t, s)
+	s.Config.Turn.SharedSecret = "turn-secret"
+
+	cl := Client{AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid}
+
+	if err := store.Create(context.Background(), &cl, "3600"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.Keys.Sign(TokenClaims{
+		Issuer:         s.Config.JWT.Issuer,
+		Expiry:         time.Now().Add(time.Hour).Unix(),
+		AccountSid:     testAccountSid,
+		ApplicationSid: testAppSid,
+		ClientSid:      testClientSid,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := MintCredentials(s.Config.Turn.SharedSecret, "", cl, 3600, time.Now())
+
+	h := s.Routes()
+
+	for _, form := range []url.Values{
+		{"ClientSid": {testClientSid}, "Password": {cl.ClientPassword}},
+		{"Token": {token}},
+		{"Username": {creds.Username}, "Password": {creds.Password}},
+	} {
+		verify := func(accSid string) Verification {
+			rec := doRequest(t, h, "POST", "/v2/Verify.json", form, accSid)
+
+			var resp VerifyResponse
+
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || len(resp.Verification) != 1 {
+				t.Fatalf("verify %v : %v %s", form, rec.Code, rec.Body)
+			}
+
+			return resp.Verification[0]
+		}
+
+		if v := verify(testAccountSid); !v.Valid {
+			t.Fatalf("owner rejected %v : %v", form, v.Reason)
+		}
+
+		// A result cached for the owner must not answer for another account
+		if v := verify(otherAccountSid); v.Valid || v.Reason != "Unknown client" || len(v.AccountSid) > 0 || len(v.ApplicationSid) > 0 {
+			t.Fatalf("client of another account verified %v : %+v", form, v)
+		}
+	}
+
+	// Signed for another application than the client's
+	token, _ = s.Keys.Sign(TokenClaims{
+		Issuer:         s.Config.JWT.Issuer,
+		Expiry:         time.Now().Add(time.Hour).Unix(),
+		AccountSid:     testAccountSid,
+		ApplicationSid: "AP00000000000000000000000000000002",
+		ClientSid:      testClientSid,
+	})
+
+	if v := verifyRequest(t, h, url.Values{"Token": {token}}); v.Valid || v.Reason != "Token does not match the client" {
+		t.Fatalf("token of another application : %+v", v)
+	}
+}
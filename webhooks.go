@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookLogSize         = 100
+	webhookMaxBackoff      = 5 * time.Minute
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+var (
+	ErrWebhookPrivateIp = errors.New("Webhook Url resolves to a loopback, link-local or private address")
+
+	webhookBaseBackoff = 1 * time.Second
+
+	// Addresses are checked when dialing so DNS answers can't point deliveries inside the network
+	webhookHTTPClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}).DialContext,
+		},
+	}
+)
+
+type WebhookResponse struct {
+	XMLName xml.Name  `xml:"Response" json:"-"`
+	Webhook []Webhook `xml:"Webhook" json:"Webhook"`
+}
+
+type WebhookDeliveryResponse struct {
+	XMLName    xml.Name          `xml:"Response" json:"-"`
+	Deliveries []WebhookDelivery `xml:"Delivery" json:"Delivery"`
+}
+
+type WebhookPayload struct {
+	XMLName xml.Name    `xml:"Response" json:"-"`
+	Event   ClientEvent `xml:"Event" json:"Event"`
+}
+
+type Webhook struct {
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	Url            string `xml:"Url" json:"Url"`
+	Secret         string `xml:"Secret" json:"Secret"`
+	EventTypes     string `xml:"EventTypes" json:"EventTypes"`
+	Format         string `xml:"Format" json:"Format"`
+	DateCreated    string `xml:"DateCreated" json:"DateCreated"`
+}
+
+type WebhookDelivery struct {
+	AccountSid     string `xml:"AccountSid" json:"AccountSid"`
+	EventId        uint64 `xml:"EventId" json:"EventId"`
+	EventType      string `xml:"EventType" json:"EventType"`
+	ApplicationSid string `xml:"ApplicationSid" json:"ApplicationSid"`
+	Url            string `xml:"Url" json:"Url"`
+	Attempt        int    `xml:"Attempt" json:"Attempt"`
+	StatusCode     int    `xml:"StatusCode" json:"StatusCode"`
+	Error          string `xml:"Error" json:"Error"`
+	DateCreated    string `xml:"DateCreated" json:"DateCreated"`
+}
+
+/*
+	Webhook matches every event type when EventTypes is empty
+*/
+func (h *Webhook) Wants(eventType string) bool {
+
+	if len(h.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range strings.Split(h.EventTypes, ",") {
+		if strings.TrimSpace(t) == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Copy safe to render, the signing secret never leaves the service
+*/
+func (h Webhook) Redacted() Webhook {
+	if len(h.Secret) > 0 {
+		h.Secret = "********"
+	}
+	return h
+}
+
+/*
+	Per application webhook configuration with bounded delivery log and dead letters,
+	keyed by AccountSid and ApplicationSid so an account only sees its own applications.
+	Kept in process memory only, every instance has its own and a restart drops
+	the webhooks along with their deliveries and dead letters
+*/
+type WebhookRegistry struct {
+	sync.RWMutex
+	hooks       map[string]*Webhook
+	deliveries  map[string][]WebhookDelivery
+	deadLetters map[string][]WebhookDelivery
+}
+
+func NewWebhookRegistry() *WebhookRegistry {
+	return &WebhookRegistry{
+		hooks:       make(map[string]*Webhook),
+		deliveries:  make(map[string][]WebhookDelivery),
+		deadLetters: make(map[string][]WebhookDelivery),
+	}
+}
+
+func webhookKey(accSid string, appSid string) string {
+	return accSid + "/" + appSid
+}
+
+func (r *WebhookRegistry) Get(accSid string, appSid string) (Webhook, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	h, ok := r.hooks[webhookKey(accSid, appSid)]
+	if !ok {
+		return Webhook{}, false
+	}
+
+	return *h, true
+}
+
+/*
+	Creates or replaces the webhook of an application of the account
+*/
+func (r *WebhookRegistry) Set(h Webhook) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.hooks[webhookKey(h.AccountSid, h.ApplicationSid)] = &h
+}
+
+func (r *WebhookRegistry) Delete(accSid string, appSid string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.hooks, webhookKey(accSid, appSid))
+}
+
+func (r *WebhookRegistry) Deliveries(accSid string, appSid string) []WebhookDelivery {
+	r.RLock()
+	defer r.RUnlock()
+
+	return append([]WebhookDelivery(nil), r.deliveries[webhookKey(accSid, appSid)]...)
+}
+
+func (r *WebhookRegistry) DeadLetters(accSid string, appSid string) []WebhookDelivery {
+	r.RLock()
+	defer r.RUnlock()
+
+	return append([]WebhookDelivery(nil), r.deadLetters[webhookKey(accSid, appSid)]...)
+}
+
+func (r *WebhookRegistry) logDelivery(d WebhookDelivery, dead bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	key := webhookKey(d.AccountSid, d.ApplicationSid)
+
+	r.deliveries[key] = appendBounded(r.deliveries[key], d)
+
+	if dead {
+		r.deadLetters[key] = appendBounded(r.deadLetters[key], d)
+	}
+}
+
+func appendBounded(list []WebhookDelivery, d WebhookDelivery) []WebhookDelivery {
+	list = append(list, d)
+	if len(list) > webhookLogSize {
+		list = list[len(list)-webhookLogSize:]
+	}
+	return list
+}
+
+/*
+	Follows the event bus for the lifetime of the service and hands every
+	event with a matching webhook to its own delivery goroutine
+*/
+func (s *Server) WebhookDispatcher() {
+	log.Infoln("Starting webhook dispatcher...")
+
+	var lastId uint64
+
+	for {
+		backlog, sub := s.Events.Subscribe(EventFilter{}, lastId)
+
+		for _, e := range backlog {
+			lastId = e.Id
+			s.dispatchWebhook(e)
+		}
+
+		for e := range sub.ch {
+			lastId = e.Id
+			s.dispatchWebhook(e)
+		}
+
+		log.Warnln("Webhook dispatcher subscription closed, resuming from event ", lastId)
+	}
+}
+
+func (s *Server) dispatchWebhook(e ClientEvent) {
+
+	h, ok := s.Webhooks.Get(e.AccountSid, e.ApplicationSid)
+
+	// Events of an application only go to the webhook its own account registered
+	if !ok || h.AccountSid != e.AccountSid || !h.Wants(e.Type) {
+		return
+	}
+
+	go s.deliverWebhook(h, e)
+}
+
+/*
+	Delivers one event with exponential backoff between attempts,
+	the last failed attempt is kept as a dead letter
+*/
+func (s *Server) deliverWebhook(h Webhook, e ClientEvent) {
+
+	body, contentType, err := encodeWebhookPayload(h.Format, e)
+
+	if err != nil {
+		log.Errorln("Error encoding webhook payload ", err.Error())
+		return
+	}
+
+	backoff := webhookBaseBackoff
+
+	maxAttempts := s.Live.Load().WebhookMaxAttempts
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+
+		d := WebhookDelivery{
+			AccountSid:     h.AccountSid,
+			EventId:        e.Id,
+			EventType:      e.Type,
+			ApplicationSid: h.ApplicationSid,
+			Url:            h.Url,
+			Attempt:        attempt,
+			DateCreated:    time.Now().Format(time.ANSIC),
+		}
+
+		d.StatusCode, err = postWebhook(h, body, contentType)
+
+		if err == nil {
+			s.Webhooks.logDelivery(d, false)
+			return
+		}
+
+		d.Error = err.Error()
+		last := attempt == maxAttempts
+		s.Webhooks.logDelivery(d, last)
+
+		log.Warnln("Webhook delivery failed for ", h.ApplicationSid, " event ", e.Id, " attempt ", attempt, " -", err.Error())
+
+		if last {
+			return
+		}
+
+		// Jitter keeps retries of a burst of events from lining up
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func postWebhook(h Webhook, body []byte, contentType string) (int, error) {
+
+	req, err := http.NewRequest("POST", h.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(h.Secret, body))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Webhook endpoint responded %v", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+/*
+	Hex encoded HMAC-SHA256 of the payload keyed by the webhook secret
+*/
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func encodeWebhookPayload(format string, e ClientEvent) ([]byte, string, error) {
+
+	payload := WebhookPayload{Event: e}
+
+	if strings.EqualFold(format, "json") {
+		b, err := json.Marshal(payload)
+		return b, "application/json", err
+	}
+
+	b, err := xml.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append([]byte(xml.Header), b...), "text/xml", nil
+}
+
+func (s *Server) GetApplicationWebhook(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("GetApplicationWebhook :")
+
+	params := mux.Vars(req)
+
+	h, ok := s.Webhooks.Get(params["AccountSid"], params["ApplicationSid"])
+
+	if !ok {
+		NoHandleFound(w, req)
+		return
+	}
+
+	renderWebhook(w, params["format"], h)
+}
+
+/*
+	Creates or replaces the webhook of an application.
+	Form values : Url, Secret, EventTypes (comma separated), Format (xml|json)
+*/
+func (s *Server) SetApplicationWebhook(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("SetApplicationWebhook :")
+
+	params := mux.Vars(req)
+
+	h := Webhook{
+		AccountSid:     params["AccountSid"],
+		ApplicationSid: params["ApplicationSid"],
+		Url:            req.FormValue("Url"),
+		Secret:         req.FormValue("Secret"),
+		EventTypes:     req.FormValue("EventTypes"),
+		Format:         strings.ToLower(req.FormValue("Format")),
+		DateCreated:    time.Now().Format(time.ANSIC),
+	}
+
+	if err := validateWebhook(h); err != nil {
+		RenderBadRequestErr(w, err)
+		return
+	}
+
+	if len(h.Format) == 0 {
+		h.Format = "xml"
+	}
+
+	s.Webhooks.Set(h)
+
+	renderWebhook(w, params["format"], h)
+}
+
+func (s *Server) DeleteApplicationWebhook(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("DeleteApplicationWebhook :")
+
+	params := mux.Vars(req)
+
+	if _, ok := s.Webhooks.Get(params["AccountSid"], params["ApplicationSid"]); !ok {
+		NoHandleFound(w, req)
+		return
+	}
+
+	s.Webhooks.Delete(params["AccountSid"], params["ApplicationSid"])
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) ListWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("ListWebhookDeliveries :")
+
+	params := mux.Vars(req)
+
+	renderWebhookDeliveries(w, params["format"], s.Webhooks.Deliveries(params["AccountSid"], params["ApplicationSid"]))
+}
+
+func (s *Server) ListWebhookDeadLetters(w http.ResponseWriter, req *http.Request) {
+	LoggerFrom(req.Context()).Infoln("ListWebhookDeadLetters :")
+
+	params := mux.Vars(req)
+
+	renderWebhookDeliveries(w, params["format"], s.Webhooks.DeadLetters(params["AccountSid"], params["ApplicationSid"]))
+}
+
+func validateWebhook(h Webhook) error {
+
+	u, err := url.Parse(h.Url)
+
+	if err != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("Invalid webhook Url " + h.Url)
+	}
+
+	// Host names are checked again on every delivery, when they are resolved
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !webhookIpAllowed(ip) {
+		return ErrWebhookPrivateIp
+	}
+
+	if len(h.Secret) == 0 {
+		return errors.New("Missing webhook Secret")
+	}
+
+	if len(h.Format) > 0 && h.Format != "xml" && h.Format != "json" {
+		return errors.New("Invalid webhook Format " + h.Format)
+	}
+
+	for _, t := range strings.Split(h.EventTypes, ",") {
+		switch strings.TrimSpace(t) {
+		case "", EventCreated, EventUpdated, EventDeleted, EventPasswordRotated, EventPresence:
+		default:
+			return errors.New("Invalid webhook event type " + t)
+		}
+	}
+
+	return nil
+}
+
+/*
+	Only public unicast addresses can receive deliveries
+*/
+func webhookIpAllowed(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !webhookIpAllowed(ip) {
+		return ErrWebhookPrivateIp
+	}
+
+	return nil
+}
+
+func renderWebhook(w http.ResponseWriter, format string, h Webhook) {
+
+	resp := WebhookResponse{Webhook: []Webhook{h.Redacted()}}
+
+	ext := ReqFormat(format)
+
+	var WebhookArg interface{}
+
+	if ext == "csv" {
+		WebhookArg = resp.Webhook
+	} else {
+		WebhookArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, WebhookArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
+
+func renderWebhookDeliveries(w http.ResponseWriter, format string, deliveries []WebhookDelivery) {
+
+	resp := WebhookDeliveryResponse{Deliveries: deliveries}
+
+	ext := ReqFormat(format)
+
+	var DeliveryArg interface{}
+
+	if ext == "csv" {
+		DeliveryArg = resp.Deliveries
+	} else {
+		DeliveryArg = resp
+	}
+
+	err := HandleResponseEncoding(w, ext, DeliveryArg)
+
+	if err != nil {
+		RenderEncodingErr(w, ext, err)
+		return
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWebhookForeignApplication(t *testing.T) {
+
+	const otherAccountSid = "AC00000000000000000000000000000002"
+
+	received := make(chan string, 2)
+
+	newTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received <- name
+		}))
+	}
+
+	owner, foreign := newTarget("owner"), newTarget("foreign")
+	defer owner.Close()
+	defer foreign.Close()
+
+	// Targets are on loopback, which deliveries refuse
+	defer func(c *http.Client) { webhookHTTPClient = c }(webhookHTTPClient)
+	webhookHTTPClient = owner.Client()
+
+	s := newTestServer(t, NewMemoryClientStore())
+	h := s.Routes()
+
+	// Another account registers a webhook on this account's ApplicationSid through its own routes
+	for accSid, target := range map[string]string{testAccountSid: owner.URL, otherAccountSid: foreign.URL} {
+		path := "/v2/Accounts/" + accSid + "/Applications/" + testAppSid + "/Webhook.json"
+		form := url.Values{"Url": {"https://hooks.example.com"}, "Secret": {"s"}, "Format": {"json"}}
+
+		if rec := doRequest(t, h, "POST", path, form, accSid); rec.Code != http.StatusOK {
+			t.Fatalf("set webhook of %v : %v %s", accSid, rec.Code, rec.Body)
+		}
+
+		hook, _ := s.Webhooks.Get(accSid, testAppSid)
+		hook.Url = target
+		s.Webhooks.Set(hook)
+	}
+
+	s.dispatchWebhook(ClientEvent{Id: 1, Type: EventCreated, AccountSid: testAccountSid, ApplicationSid: testAppSid, ClientSid: testClientSid})
+
+	select {
+	case got := <-received:
+		if got != "owner" {
+			t.Fatalf("event delivered to the %v webhook", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered to the owner's webhook")
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("event also delivered to the %v webhook", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if d := s.Webhooks.Deliveries(otherAccountSid, testAppSid); len(d) != 0 {
+		t.Fatalf("deliveries listed to another account : %+v", d)
+	}
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+
+	for u, ok := range map[string]bool{
+		"https://hooks.example.com/events": true,
+		"https://203.0.113.10/events":      true,
+		"http://127.0.0.1:8080/":           false,
+		"http://[::1]/":                    false,
+		"http://10.1.2.3/":                 false,
+		"http://192.168.0.1/":              false,
+		"http://169.254.169.254/latest":    false,
+		"http://0.0.0.0/":                  false,
+	} {
+		err := validateWebhook(Webhook{Url: u, Secret: "s"})
+
+		if (err == nil) != ok {
+			t.Errorf("%v : %v", u, err)
+		}
+	}
+
+	// Host names are only resolved on delivery
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	if _, err := postWebhook(Webhook{Url: srv.URL, Secret: "s"}, nil, "application/json"); !errors.Is(err, ErrWebhookPrivateIp) {
+		t.Fatalf("delivery to %v : %v", srv.URL, err)
+	}
+}